@@ -0,0 +1,306 @@
+package logf
+
+import (
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrWriterClosed is returned when writing to a writer that has been closed.
+var ErrWriterClosed = errors.New("logf: writer closed")
+
+// flusher is implemented by writers that buffer data, like bufio.Writer.
+type flusher interface {
+	Flush() error
+}
+
+const defaultAsyncSize = 1024
+
+// AsyncOpts represents the config options for AsyncWriter.
+type AsyncOpts struct {
+	// Number of lines queued before writes block or are dropped.
+	// Defaults to 1024.
+	Size int
+
+	// DropOnFull drops lines instead of blocking when the queue is full.
+	DropOnFull bool
+
+	// OnDrop, if set, is called with the level and the line whenever a
+	// line is dropped because the queue is full. It's called on the
+	// logging goroutine, so it must be fast and must not log to the
+	// same writer.
+	OnDrop func(lvl Level, line string)
+
+	// FlushInterval, if set, flushes the underlying writer at this
+	// interval if it supports flushing (eg: a bufio.Writer or a
+	// BufferedWriter), so that lines don't sit in its buffer when there
+	// are few logs. The ticker is stopped on Close.
+	FlushInterval time.Duration
+
+	// TimestampAtWrite stamps lines logged by a Logger writing directly
+	// to this writer with the time they're written out, from the Logger's
+	// Opts.Clock if it's set, instead of the time they were logged. Timestamps then no longer tell when an event
+	// happened, and lines queued during a burst get close timestamps. It
+	// also costs a copy of every line when it's written. Lines written
+	// by WriteEntries or through other writers are written as is.
+	TimestampAtWrite bool
+
+	// ErrorWriter, if set, gets a structured log line when writing to or
+	// flushing the underlying writer fails, like Opts.ErrorWriter, instead
+	// of the plain text written to the standard library logger.
+	ErrorWriter io.Writer
+}
+
+// asyncLine is a queued line. If layout is set, ts is the position of
+// the timestamp in b, to be replaced with the time from clock (or
+// time.Now if it's nil) when the line is written.
+type asyncLine struct {
+	lvl    Level
+	b      []byte
+	ts     [2]int
+	layout string
+	clock  func() time.Time
+}
+
+// AsyncWriter is an io.Writer that queues lines in a buffered channel
+// and writes them to the underlying writer from a background goroutine,
+// so that logging doesn't block on a slow writer.
+type AsyncWriter struct {
+	w    io.Writer
+	ch   chan asyncLine
+	opts AsyncOpts
+
+	// Logger for write errors, from AsyncOpts.ErrorWriter.
+	errLog *Logger
+
+	// mu guards closed. Writes hold the read lock while queueing so that
+	// Close can wait for in-flight writes before draining.
+	mu     sync.RWMutex
+	closed bool
+
+	// quit unblocks writes waiting on a full queue, drain tells the
+	// goroutine to write what's queued and exit, abort tells it to
+	// discard what's queued instead.
+	quit      chan struct{}
+	flushReq  chan chan error
+	drain     chan struct{}
+	abort     chan struct{}
+	done      chan struct{}
+	closeOnce sync.Once
+	abortOnce sync.Once
+
+	// Number of queued lines discarded on abort. Only written by the
+	// goroutine before done is closed.
+	dropped int
+}
+
+// NewAsyncWriter returns an AsyncWriter writing to w.
+func NewAsyncWriter(w io.Writer, opts AsyncOpts) *AsyncWriter {
+	if opts.Size <= 0 {
+		opts.Size = defaultAsyncSize
+	}
+
+	a := &AsyncWriter{
+		w:        w,
+		ch:       make(chan asyncLine, opts.Size),
+		opts:     opts,
+		quit:     make(chan struct{}),
+		flushReq: make(chan chan error),
+		drain:    make(chan struct{}),
+		abort:    make(chan struct{}),
+		done:     make(chan struct{}),
+	}
+	if opts.ErrorWriter != nil {
+		errLog := New(Opts{Writer: opts.ErrorWriter})
+		a.errLog = &errLog
+	}
+	go a.run()
+
+	return a
+}
+
+// Write queues a copy of p to be written by the background goroutine.
+// If the queue is full, it blocks or drops p if DropOnFull is set. It
+// returns ErrWriterClosed once the writer has been closed.
+func (a *AsyncWriter) Write(p []byte) (int, error) {
+	return a.WriteLevel(0, p)
+}
+
+// WriteLevel is the same as Write, passing lvl to OnDrop if p is dropped.
+func (a *AsyncWriter) WriteLevel(lvl Level, p []byte) (int, error) {
+	return a.enqueue(lvl, p, [2]int{}, "", nil)
+}
+
+// writeStamped queues p with the position of its timestamp, formatted
+// with layout, to be replaced with the time from clock when it's written.
+func (a *AsyncWriter) writeStamped(lvl Level, p []byte, ts [2]int, layout string, clock func() time.Time) (int, error) {
+	return a.enqueue(lvl, p, ts, layout, clock)
+}
+
+func (a *AsyncWriter) enqueue(lvl Level, p []byte, ts [2]int, layout string, clock func() time.Time) (int, error) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+
+	if a.closed {
+		return 0, ErrWriterClosed
+	}
+
+	b := make([]byte, len(p))
+	copy(b, p)
+	line := asyncLine{lvl: lvl, b: b, ts: ts, layout: layout, clock: clock}
+
+	if a.opts.DropOnFull {
+		select {
+		case a.ch <- line:
+		default:
+			if a.opts.OnDrop != nil {
+				a.opts.OnDrop(lvl, string(p))
+			}
+		}
+		return len(p), nil
+	}
+
+	select {
+	case a.ch <- line:
+		return len(p), nil
+	case <-a.quit:
+		return 0, ErrWriterClosed
+	}
+}
+
+// Flush writes the lines queued so far and flushes the underlying writer
+// if it supports flushing. A Logger calls it before exiting after a Fatal
+// log. It's a no-op once the writer is closed, as Close does the same.
+func (a *AsyncWriter) Flush() error {
+	reply := make(chan error, 1)
+	select {
+	case a.flushReq <- reply:
+	case <-a.done:
+		return nil
+	}
+
+	return <-reply
+}
+
+// Close stops accepting writes, writes all the queued lines and
+// flushes the underlying writer.
+func (a *AsyncWriter) Close() error {
+	_, err := a.CloseWithContext(context.Background())
+	return err
+}
+
+// CloseWithContext stops accepting writes and writes the queued lines
+// until the queue is empty or ctx is cancelled, then flushes the
+// underlying writer. On cancellation, the remaining lines are discarded
+// and their count is returned along with the context's error. A write to
+// the underlying writer that's already in progress isn't interrupted.
+func (a *AsyncWriter) CloseWithContext(ctx context.Context) (int, error) {
+	a.closeOnce.Do(func() {
+		close(a.quit)
+
+		// Wait for in-flight writes before asking the goroutine to drain.
+		a.mu.Lock()
+		a.closed = true
+		a.mu.Unlock()
+
+		close(a.drain)
+	})
+
+	select {
+	case <-a.done:
+		return a.dropped, nil
+	case <-ctx.Done():
+		a.abortOnce.Do(func() { close(a.abort) })
+		<-a.done
+		return a.dropped, ctx.Err()
+	}
+}
+
+// run writes queued lines to the underlying writer until the writer is closed.
+func (a *AsyncWriter) run() {
+	defer close(a.done)
+
+	var tick <-chan time.Time
+	if a.opts.FlushInterval > 0 {
+		t := time.NewTicker(a.opts.FlushInterval)
+		defer t.Stop()
+		tick = t.C
+	}
+
+	for {
+		select {
+		case line := <-a.ch:
+			a.write(line)
+		case <-tick:
+			a.flush()
+		case reply := <-a.flushReq:
+			a.drainQueue()
+			reply <- a.flushWriter()
+		case <-a.drain:
+			a.drainQueue()
+			a.flush()
+			return
+		}
+	}
+}
+
+// drainQueue writes the remaining queued lines, or discards them if
+// the close has been aborted.
+func (a *AsyncWriter) drainQueue() {
+	for {
+		select {
+		case line := <-a.ch:
+			a.write(line)
+		default:
+			return
+		}
+	}
+}
+
+// write writes b to the underlying writer, or discards it if the close
+// has been aborted.
+func (a *AsyncWriter) write(line asyncLine) {
+	select {
+	case <-a.abort:
+		a.dropped++
+		return
+	default:
+	}
+
+	b := line.b
+	if line.layout != "" {
+		now := time.Now
+		if line.clock != nil {
+			now = line.clock
+		}
+
+		b = make([]byte, 0, len(line.b)+8)
+		b = append(b, line.b[:line.ts[0]]...)
+		b = now().AppendFormat(b, line.layout)
+		b = append(b, line.b[line.ts[1]:]...)
+	}
+
+	if _, err := writeFull(a.w, b); err != nil {
+		// Should ideally never happen.
+		reportWriteError(a.errLog, line.lvl, b, err)
+	}
+}
+
+// flush flushes the underlying writer if it supports flushing, logging
+// the error if it fails.
+func (a *AsyncWriter) flush() {
+	if err := a.flushWriter(); err != nil {
+		reportFlushError(a.errLog, err)
+	}
+}
+
+// flushWriter flushes the underlying writer if it supports flushing.
+func (a *AsyncWriter) flushWriter() error {
+	f, ok := a.w.(flusher)
+	if !ok {
+		return nil
+	}
+	return f.Flush()
+}
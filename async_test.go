@@ -0,0 +1,271 @@
+package logf
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// safeBuffer is a bytes.Buffer that's safe for concurrent use.
+type safeBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+// slowWriter blocks every write until it's released.
+type slowWriter struct {
+	release chan struct{}
+	safeBuffer
+}
+
+func (w *slowWriter) Write(p []byte) (int, error) {
+	<-w.release
+	return w.safeBuffer.Write(p)
+}
+
+func TestAsyncWriter(t *testing.T) {
+	buf := &safeBuffer{}
+	w := NewAsyncWriter(buf, AsyncOpts{})
+	l := New(Opts{Writer: w})
+
+	for i := 0; i < 10; i++ {
+		l.Info("hello world", "index", i)
+	}
+	require.NoError(t, w.Close())
+	require.Equal(t, 10, strings.Count(buf.String(), `message="hello world"`))
+
+	// Writes after closing fail.
+	_, err := w.Write([]byte("line\n"))
+	require.ErrorIs(t, err, ErrWriterClosed)
+
+	// Closing again is a no-op.
+	require.NoError(t, w.Close())
+}
+
+func TestAsyncWriterFlushesOnClose(t *testing.T) {
+	buf := &safeBuffer{}
+	bw := bufio.NewWriterSize(buf, 1<<16)
+	w := NewAsyncWriter(bw, AsyncOpts{})
+
+	_, err := w.Write([]byte("line\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.Equal(t, "line\n", buf.String())
+}
+
+func TestAsyncWriterFlush(t *testing.T) {
+	buf := &safeBuffer{}
+	bw := bufio.NewWriterSize(buf, 1<<16)
+	w := NewAsyncWriter(bw, AsyncOpts{})
+
+	_, err := w.Write([]byte("one\n"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("two\n"))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	require.Equal(t, "one\ntwo\n", buf.String())
+
+	// Flushing a closed writer is a no-op.
+	require.NoError(t, w.Close())
+	require.NoError(t, w.Flush())
+}
+
+func TestAsyncWriterFatal(t *testing.T) {
+	buf := &safeBuffer{}
+	w := NewAsyncWriter(buf, AsyncOpts{})
+
+	var flushed string
+	l := New(Opts{Writer: w, ExitFunc: func(int) { flushed = buf.String() }})
+	l.Info("one")
+	l.Fatal("boom")
+	require.Contains(t, flushed, "message=one\n", "queued lines are written before exiting")
+	require.Contains(t, flushed, "level=fatal message=boom\n")
+	require.NoError(t, w.Close())
+}
+
+func TestAsyncWriterRecoverAndLog(t *testing.T) {
+	buf := &safeBuffer{}
+	w := NewAsyncWriter(buf, AsyncOpts{})
+	l := New(Opts{Writer: w})
+
+	var out string
+	func() {
+		defer func() {
+			recover()
+			out = buf.String()
+		}()
+		defer l.RecoverAndLog()
+		l.Info("one")
+		panic("boom")
+	}()
+	require.Contains(t, out, "message=one\n")
+	require.Contains(t, out, "message=\"recovered panic\" panic=boom")
+	require.NoError(t, w.Close())
+}
+
+func TestAsyncWriterErrorWriter(t *testing.T) {
+	errBuf := &safeBuffer{}
+	w := NewAsyncWriter(failingWriter{}, AsyncOpts{ErrorWriter: errBuf})
+	l := New(Opts{Writer: w})
+	l.Warn("hello")
+	w.Write([]byte("raw\n"))
+	require.NoError(t, w.Close())
+
+	lines := strings.Split(strings.TrimSuffix(errBuf.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	require.Contains(t, lines[0], `level=error message="error logging" error="broken pipe" log_level=warn line="timestamp=`)
+	require.Contains(t, lines[1], `level=error message="error logging" error="broken pipe" line=raw`)
+}
+
+func TestAsyncWriterCloseWithContext(t *testing.T) {
+	sw := &slowWriter{release: make(chan struct{})}
+	w := NewAsyncWriter(sw, AsyncOpts{})
+
+	for i := 0; i < 5; i++ {
+		_, err := w.Write([]byte("line\n"))
+		require.NoError(t, err)
+	}
+
+	// Let the in-flight write through once the close is aborted.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	go func() {
+		<-w.abort
+		close(sw.release)
+	}()
+
+	dropped, err := w.CloseWithContext(ctx)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Equal(t, 4, dropped, "all but the in-flight write should be dropped")
+	require.Equal(t, "line\n", sw.String())
+}
+
+func TestAsyncWriterOnDrop(t *testing.T) {
+	sw := &slowWriter{release: make(chan struct{})}
+
+	var (
+		mu      sync.Mutex
+		dropped []Level
+	)
+	w := NewAsyncWriter(sw, AsyncOpts{Size: 2, DropOnFull: true, OnDrop: func(lvl Level, line string) {
+		mu.Lock()
+		dropped = append(dropped, lvl)
+		mu.Unlock()
+		require.Contains(t, line, "message=dropped")
+	}})
+	l := New(Opts{Writer: w})
+
+	// Wait for the goroutine to block on the first line, then fill the queue.
+	l.Info("queued")
+	require.Eventually(t, func() bool { return len(w.ch) == 0 }, time.Second, time.Millisecond)
+	l.Info("queued")
+	l.Info("queued")
+
+	l.Warn("dropped")
+	l.Error("dropped")
+
+	mu.Lock()
+	require.Equal(t, []Level{WarnLevel, ErrorLevel}, dropped)
+	mu.Unlock()
+
+	close(sw.release)
+	require.NoError(t, w.Close())
+	require.NotContains(t, sw.String(), "message=dropped")
+}
+
+func TestAsyncWriterFlushInterval(t *testing.T) {
+	buf := &safeBuffer{}
+	w := NewAsyncWriter(bufio.NewWriter(buf), AsyncOpts{FlushInterval: 10 * time.Millisecond})
+	l := New(Opts{Writer: w})
+
+	// The line is flushed out of the bufio.Writer without further writes.
+	l.Info("hello world")
+	require.Eventually(t, func() bool {
+		return strings.Contains(buf.String(), `message="hello world"`)
+	}, time.Second, 5*time.Millisecond)
+
+	// The ticker goroutine exits on Close.
+	require.NoError(t, w.Close())
+	select {
+	case <-w.done:
+	default:
+		t.Fatal("goroutine still running after Close")
+	}
+}
+
+func TestAsyncWriterTimestampAtWrite(t *testing.T) {
+	const delay = 50 * time.Millisecond
+
+	for _, f := range []Format{FormatLogfmt, FormatJSON, FormatConsole} {
+		for _, atWrite := range []bool{false, true} {
+			sink := &slowWriter{release: make(chan struct{})}
+			w := NewAsyncWriter(sink, AsyncOpts{TimestampAtWrite: atWrite})
+			l := New(Opts{Writer: w, Format: f, TimestampFormat: time.RFC3339Nano})
+
+			// The first line blocks the consumer, so the second one
+			// stays queued until the sink is released.
+			l.Info("first")
+			require.Eventually(t, func() bool { return len(w.ch) == 0 }, time.Second, time.Millisecond)
+			logged := time.Now()
+			l.Info("hello world", "key", "val")
+			time.Sleep(delay)
+			close(sink.release)
+			require.NoError(t, w.Close())
+
+			lines := strings.Split(strings.TrimSpace(sink.String()), "\n")
+			require.Len(t, lines, 2)
+			line := lines[1]
+			re := regexp.MustCompile(`\d{4}-\d\d-\d\dT[^ "]+`)
+			ts, err := time.Parse(time.RFC3339Nano, re.FindString(line))
+			require.NoError(t, err, line)
+			if atWrite {
+				require.True(t, ts.Sub(logged) >= delay, "stamped at write time: %s", line)
+			} else {
+				require.True(t, ts.Sub(logged) < delay, "stamped at log time: %s", line)
+			}
+			require.Contains(t, line, "hello world")
+			require.Contains(t, line, "val")
+		}
+	}
+}
+
+func TestAsyncWriterTimestampAtWriteClock(t *testing.T) {
+	// Lines are stamped with the logger's clock when they're written.
+	now := time.Date(2022, 7, 7, 12, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		now = now.Add(time.Second)
+		return now
+	}
+
+	sink := &shortWriter{max: 8}
+	w := NewAsyncWriter(sink, AsyncOpts{TimestampAtWrite: true})
+	l := New(Opts{Writer: w, Clock: clock, TimestampFormat: time.RFC3339})
+	l.Info("hello")
+	require.NoError(t, w.Close())
+
+	// Short writes are retried for the rest of the line.
+	require.Equal(t, "timestamp=2022-07-07T12:00:03Z level=info message=hello\n", sink.String())
+	require.Greater(t, sink.calls, 1)
+}
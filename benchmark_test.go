@@ -3,11 +3,64 @@ package logf_test
 import (
 	"errors"
 	"io"
+	"strings"
 	"testing"
 
 	"github.com/zerodha/logf"
 )
 
+func BenchmarkRepeatedKeys(b *testing.B) {
+	keys := []string{"request_id", "status", "method", "duration_ms", "user_agent"}
+	for _, bc := range []struct {
+		name string
+		opts logf.Opts
+	}{
+		{"Logfmt", logf.Opts{Writer: io.Discard}},
+		{"LogfmtKnownKeys", logf.Opts{Writer: io.Discard, KnownKeys: keys}},
+		{"JSON", logf.Opts{Writer: io.Discard, Format: logf.FormatJSON}},
+		{"JSONKnownKeys", logf.Opts{Writer: io.Discard, Format: logf.FormatJSON, KnownKeys: keys}},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			logger := logf.New(bc.opts)
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(p *testing.PB) {
+				for p.Next() {
+					logger.Info("request completed", "request_id", "8f3e2a", "status", 200, "method", "GET", "duration_ms", 12, "user_agent", "curl")
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkManyFields(b *testing.B) {
+	defaults := []interface{}{"service", "api", "env", "prod", "region", "eu", "host", "web-1", "version", "1.2.3", "pid", 42}
+	unique := []interface{}{
+		"request_id", "8f3e2a", "status", 200, "method", "GET", "path", "/users", "duration_ms", 12, "bytes", 512,
+		"user_id", 7, "user_agent", "curl", "remote_addr", "10.0.0.1", "proto", "HTTP/1.1", "cache", "miss", "retries", 0,
+	}
+	repeated := append(append([]interface{}{}, unique...), "status", 500, "env", "staging")
+
+	for _, bc := range []struct {
+		name   string
+		fields []interface{}
+	}{
+		{"Unique", unique},
+		{"Repeated", repeated},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			logger := logf.New(logf.Opts{Writer: io.Discard, DefaultFields: defaults})
+			b.ReportAllocs()
+			b.ResetTimer()
+			b.RunParallel(func(p *testing.PB) {
+				for p.Next() {
+					logger.Info("request completed", bc.fields...)
+				}
+			})
+		})
+	}
+}
+
 func BenchmarkNoField(b *testing.B) {
 	logger := logf.New(logf.Opts{Writer: io.Discard})
 	b.ReportAllocs()
@@ -41,6 +94,28 @@ func BenchmarkOneFieldWithDefaultFields(b *testing.B) {
 	})
 }
 
+func BenchmarkPersistentFields_PerCall(b *testing.B) {
+	logger := logf.New(logf.Opts{Writer: io.Discard})
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			logger.Info("hello world", "service", "api", "version", "v1.0.0", "env", "prod", "stack", "testing")
+		}
+	})
+}
+
+func BenchmarkPersistentFields_Preserialized(b *testing.B) {
+	logger := logf.New(logf.Opts{Writer: io.Discard}).With("service", "api", "version", "v1.0.0", "env", "prod")
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			logger.Info("hello world", "stack", "testing")
+		}
+	})
+}
+
 func BenchmarkThreeFields(b *testing.B) {
 	logger := logf.New(logf.Opts{Writer: io.Discard})
 	b.ReportAllocs()
@@ -92,6 +167,29 @@ func BenchmarkHugePayload(b *testing.B) {
 	})
 }
 
+func BenchmarkLargeLine(b *testing.B) {
+	benchmarkLargeLine(b)
+}
+
+func BenchmarkLargeLine_WithBufferSize(b *testing.B) {
+	logf.SetBufferSize(16 << 10)
+	defer logf.SetBufferSize(0)
+	benchmarkLargeLine(b)
+}
+
+func benchmarkLargeLine(b *testing.B) {
+	logger := logf.New(logf.Opts{Writer: io.Discard})
+	payload := strings.Repeat("a", 8<<10)
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			logger.Info("large line", "payload", payload)
+		}
+	})
+}
+
 func BenchmarkThreeFields_WithCaller(b *testing.B) {
 	logger := logf.New(logf.Opts{Writer: io.Discard, CallerSkipFrameCount: 3, EnableCaller: true})
 	b.ReportAllocs()
@@ -106,6 +204,34 @@ func BenchmarkThreeFields_WithCaller(b *testing.B) {
 	})
 }
 
+func BenchmarkThreeFields_CallerMinLevel(b *testing.B) {
+	logger := logf.New(logf.Opts{Writer: io.Discard, CallerSkipFrameCount: 3, EnableCaller: true, CallerMinLevel: logf.WarnLevel})
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			logger.Info("request completed",
+				"component", "api", "method", "GET", "bytes", 1<<18,
+			)
+		}
+	})
+}
+
+func BenchmarkThreeFields_JSON(b *testing.B) {
+	logger := logf.New(logf.Opts{Writer: io.Discard, Format: logf.FormatJSON})
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			logger.Info("request completed",
+				"component", "api", "method", "GET", "bytes", 1<<18,
+			)
+		}
+	})
+}
+
 func BenchmarkNoField_WithColor(b *testing.B) {
 	logger := logf.New(logf.Opts{Writer: io.Discard, EnableColor: true})
 	b.ReportAllocs()
@@ -179,3 +305,43 @@ func BenchmarkHugePayload_WithColor(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkWriteEntries(b *testing.B) {
+	logger := logf.New(logf.Opts{Writer: io.Discard})
+	entries := make([]logf.Entry, 100)
+	for i := range entries {
+		entries[i] = logf.Entry{Level: logf.InfoLevel, Message: "request completed", Fields: []interface{}{"component", "api", "method", "GET", "bytes", 1 << 18}}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			logger.WriteEntries(entries)
+		}
+	})
+}
+
+func BenchmarkWriteEntries_OneByOne(b *testing.B) {
+	logger := logf.New(logf.Opts{Writer: io.Discard})
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(p *testing.PB) {
+		for p.Next() {
+			for i := 0; i < 100; i++ {
+				logger.Info("request completed", "component", "api", "method", "GET", "bytes", 1<<18)
+			}
+		}
+	})
+}
+
+func BenchmarkInfoNoFields(b *testing.B) {
+	logger := logf.New(logf.Opts{Writer: io.Discard})
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		logger.Info("hello world")
+	}
+}
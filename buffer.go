@@ -1,14 +1,32 @@
 package logf
 
 import (
+	"math"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+// Buffers that have grown beyond this capacity (or the size set with
+// SetBufferSize, if larger) aren't put back in the pool, so that
+// a few huge lines don't remain in memory.
+const maxPooledBufferSize = 1 << 16
+
+// SetBufferSize sets the initial capacity of the buffers used to
+// serialize log lines. Setting it to the typical line size avoids the
+// buffer growing on every line for workloads with large lines.
+func SetBufferSize(n int) {
+	atomic.StoreInt64(&bufPool.size, int64(n))
+}
+
 // ref: https://github.com/VictoriaMetrics/VictoriaMetrics/blob/master/lib/bytesutil/bytebuffer.go
 // byteBufferPool is a pool of byteBuffer
 type byteBufferPool struct {
+	// Initial capacity of new buffers. It's the first field so that it's
+	// 64-bit aligned for the atomic operations on 32-bit platforms.
+	size int64
+
 	p sync.Pool
 }
 
@@ -16,17 +34,30 @@ type byteBufferPool struct {
 func (bbp *byteBufferPool) Get() *byteBuffer {
 	bbv := bbp.p.Get()
 	if bbv == nil {
-		return &byteBuffer{}
+		return &byteBuffer{B: make([]byte, 0, atomic.LoadInt64(&bbp.size))}
 	}
 	return bbv.(*byteBuffer)
 }
 
 // Put puts back the ByteBuffer into the object pool
 func (bbp *byteBufferPool) Put(bb *byteBuffer) {
+	if !bbp.poolable(bb) {
+		return
+	}
+
 	bb.Reset()
 	bbp.p.Put(bb)
 }
 
+// poolable returns false if the buffer has grown too large to be pooled.
+func (bbp *byteBufferPool) poolable(bb *byteBuffer) bool {
+	max := atomic.LoadInt64(&bbp.size)
+	if max < maxPooledBufferSize {
+		max = maxPooledBufferSize
+	}
+	return int64(cap(bb.B)) <= max
+}
+
 // byteBuffer is a wrapper around byte array
 type byteBuffer struct {
 	B []byte
@@ -42,11 +73,21 @@ func (bb *byteBuffer) AppendString(s string) {
 	bb.B = append(bb.B, s...)
 }
 
+// AppendBytes appends a byte slice to the buffer.
+func (bb *byteBuffer) AppendBytes(b []byte) {
+	bb.B = append(bb.B, b...)
+}
+
 // AppendInt appends an integer to the underlying buffer (assuming base 10).
 func (bb *byteBuffer) AppendInt(i int64) {
 	bb.B = strconv.AppendInt(bb.B, i, 10)
 }
 
+// AppendUint appends an unsigned integer to the underlying buffer (assuming base 10).
+func (bb *byteBuffer) AppendUint(i uint64) {
+	bb.B = strconv.AppendUint(bb.B, i, 10)
+}
+
 // AppendTime appends the time formatted using the specified layout.
 func (bb *byteBuffer) AppendTime(t time.Time, layout string) {
 	bb.B = t.AppendFormat(bb.B, layout)
@@ -62,11 +103,28 @@ func (bb *byteBuffer) AppendFloat(f float64, bitSize int) {
 	bb.B = strconv.AppendFloat(bb.B, f, 'f', -1, bitSize)
 }
 
+// AppendComplex appends a complex number in the a+bi form. bitSize is the
+// size of each part, 32 for complex64 and 64 for complex128.
+func (bb *byteBuffer) AppendComplex(c complex128, bitSize int) {
+	bb.AppendFloat(real(c), bitSize)
+	// AppendFloat writes the sign of negative and infinite values.
+	if im := imag(c); !math.Signbit(im) && !math.IsInf(im, 0) {
+		bb.AppendByte('+')
+	}
+	bb.AppendFloat(imag(c), bitSize)
+	bb.AppendByte('i')
+}
+
 // Bytes returns a mutable reference to the underlying buffer.
 func (bb *byteBuffer) Bytes() []byte {
 	return bb.B
 }
 
+// Len returns the number of bytes in the buffer.
+func (bb *byteBuffer) Len() int {
+	return len(bb.B)
+}
+
 // Reset resets the underlying buffer.
 func (bb *byteBuffer) Reset() {
 	bb.B = bb.B[:0]
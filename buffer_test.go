@@ -0,0 +1,32 @@
+package logf
+
+import (
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferPoolSize(t *testing.T) {
+	p := &byteBufferPool{}
+
+	// New buffers use the size hint.
+	atomic.StoreInt64(&p.size, 1024)
+	bb := p.Get()
+	require.Equal(t, 1024, cap(bb.B))
+	require.Equal(t, 0, len(bb.B))
+}
+
+func TestBufferPoolCap(t *testing.T) {
+	p := &byteBufferPool{}
+
+	require.True(t, p.poolable(&byteBuffer{B: make([]byte, 0, maxPooledBufferSize)}))
+
+	// Buffers past the cap aren't pooled.
+	bb := &byteBuffer{B: make([]byte, 0, maxPooledBufferSize+1)}
+	require.False(t, p.poolable(bb))
+
+	// Unless the size hint is larger than the cap.
+	atomic.StoreInt64(&p.size, maxPooledBufferSize*2)
+	require.True(t, p.poolable(bb))
+}
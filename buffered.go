@@ -0,0 +1,95 @@
+package logf
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+const defaultBufferedSize = 4096
+
+// BufferedOpts represents the config options for BufferedWriter.
+type BufferedOpts struct {
+	// Size in bytes after which the buffer is flushed. Defaults to 4096.
+	Size int
+
+	// FlushInterval, if set, flushes the buffer on a write if this much
+	// time has passed since the last flush.
+	FlushInterval time.Duration
+
+	// Lines at or above this level are flushed immediately, along with
+	// everything buffered before them. Defaults to ErrorLevel.
+	FlushLevel Level
+}
+
+// BufferedWriter accumulates lines in memory and writes them to the
+// underlying writer in chunks to save syscalls. It implements LevelWriter
+// so that lines at or above FlushLevel are never delayed.
+type BufferedWriter struct {
+	mu        sync.Mutex
+	w         io.Writer
+	buf       []byte
+	lastFlush time.Time
+	opts      BufferedOpts
+}
+
+// NewBufferedWriter returns a BufferedWriter writing to w.
+func NewBufferedWriter(w io.Writer, opts BufferedOpts) *BufferedWriter {
+	if opts.Size <= 0 {
+		opts.Size = defaultBufferedSize
+	}
+	if opts.FlushLevel == 0 {
+		opts.FlushLevel = ErrorLevel
+	}
+
+	return &BufferedWriter{
+		w:         w,
+		buf:       make([]byte, 0, opts.Size),
+		lastFlush: time.Now(),
+		opts:      opts,
+	}
+}
+
+// Write buffers p. Lines written without a level are never flushed
+// immediately because of their level.
+func (b *BufferedWriter) Write(p []byte) (int, error) {
+	return b.WriteLevel(0, p)
+}
+
+// WriteLevel buffers p and flushes the buffer if it's full, the flush
+// interval has passed or lvl is at or above FlushLevel.
+func (b *BufferedWriter) WriteLevel(lvl Level, p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.buf = append(b.buf, p...)
+
+	if len(b.buf) >= b.opts.Size || lvl >= b.opts.FlushLevel ||
+		(b.opts.FlushInterval > 0 && time.Since(b.lastFlush) >= b.opts.FlushInterval) {
+		if err := b.flush(); err != nil {
+			return 0, err
+		}
+	}
+
+	return len(p), nil
+}
+
+// Flush writes the buffered lines to the underlying writer.
+func (b *BufferedWriter) Flush() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	return b.flush()
+}
+
+func (b *BufferedWriter) flush() error {
+	b.lastFlush = time.Now()
+	if len(b.buf) == 0 {
+		return nil
+	}
+
+	_, err := b.w.Write(b.buf)
+	b.buf = b.buf[:0]
+
+	return err
+}
@@ -0,0 +1,65 @@
+package logf
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestBufferedWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewBufferedWriter(buf, BufferedOpts{})
+	l := New(Opts{Writer: w})
+
+	// Info lines are buffered.
+	l.Info("first")
+	l.Warn("second")
+	require.Empty(t, buf.String())
+
+	// Errors flush everything buffered so far.
+	l.Error("third")
+	require.Equal(t, 3, strings.Count(buf.String(), "\n"))
+	require.True(t, strings.Index(buf.String(), "first") < strings.Index(buf.String(), "third"), "order is preserved")
+	buf.Reset()
+
+	l.Info("fourth")
+	require.Empty(t, buf.String())
+	require.NoError(t, w.Flush())
+	require.Contains(t, buf.String(), `message=fourth`)
+}
+
+func TestBufferedWriterThresholds(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	// Size threshold.
+	w := NewBufferedWriter(buf, BufferedOpts{Size: 10})
+	_, err := w.Write([]byte("12345\n"))
+	require.NoError(t, err)
+	require.Empty(t, buf.String())
+	_, err = w.Write([]byte("67890\n"))
+	require.NoError(t, err)
+	require.Equal(t, "12345\n67890\n", buf.String())
+	buf.Reset()
+
+	// Configured flush level.
+	w = NewBufferedWriter(buf, BufferedOpts{FlushLevel: WarnLevel})
+	l := New(Opts{Writer: w})
+	l.Info("buffered")
+	require.Empty(t, buf.String())
+	l.Warn("flushed")
+	require.Contains(t, buf.String(), "message=buffered")
+	buf.Reset()
+
+	// Time threshold.
+	w = NewBufferedWriter(buf, BufferedOpts{FlushInterval: 10 * time.Millisecond})
+	_, err = w.Write([]byte("first\n"))
+	require.NoError(t, err)
+	require.Empty(t, buf.String())
+	time.Sleep(20 * time.Millisecond)
+	_, err = w.Write([]byte("second\n"))
+	require.NoError(t, err)
+	require.Equal(t, "first\nsecond\n", buf.String())
+}
@@ -0,0 +1,17 @@
+//go:build !logf_nodebug
+// +build !logf_nodebug
+
+package logf
+
+// Debug emits a debug log line.
+func (l Logger) Debug(msg string, fields ...interface{}) {
+	l.handleLog(msg, DebugLevel, fields...)
+}
+
+// Debugln emits a debug log line with the args formatted like fmt.Sprintln.
+func (l Logger) Debugln(args ...interface{}) {
+	if DebugLevel < l.minLevel() {
+		return
+	}
+	l.handleLog(sprintln(args...), DebugLevel)
+}
@@ -0,0 +1,16 @@
+//go:build logf_nodebug
+// +build logf_nodebug
+
+package logf
+
+// Building with the logf_nodebug tag (go build -tags logf_nodebug) turns
+// Debug and Debugln into empty functions that the compiler inlines away,
+// skipping even the level check. Arguments are still evaluated if they
+// have side effects, eg: function calls. Debug lines written with
+// WriteEntries aren't affected.
+
+// Debug does nothing when built with the logf_nodebug tag.
+func (l Logger) Debug(msg string, fields ...interface{}) {}
+
+// Debugln does nothing when built with the logf_nodebug tag.
+func (l Logger) Debugln(args ...interface{}) {}
@@ -0,0 +1,28 @@
+//go:build logf_nodebug
+// +build logf_nodebug
+
+package logf
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// Run with: go test -tags logf_nodebug -run TestNoDebug
+func TestNoDebug(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Level: DebugLevel})
+
+	l.Debug("hidden", "key", "val")
+	l.Debugln("hidden")
+	require.Empty(t, buf.String())
+
+	l.Info("visible")
+	require.Contains(t, buf.String(), "message=visible")
+
+	require.Zero(t, testing.AllocsPerRun(100, func() {
+		l.Debug("hidden")
+	}))
+}
@@ -0,0 +1,122 @@
+package logf
+
+import (
+	"bytes"
+	"sync"
+	"time"
+)
+
+const (
+	repeatedKey = "repeated"
+
+	// Default time after which the repeats of a line are written.
+	defaultDedupInterval = 10 * time.Second
+)
+
+// deduper collapses consecutive identical lines. The first line is
+// written as is and its repeats are dropped. When a different line
+// arrives, or after the interval, the last repeat is written with a
+// repeated=<n> field. It's shared by copies of a Logger.
+type deduper struct {
+	mu       sync.Mutex
+	out      *syncWriter
+	errLog   *Logger
+	interval time.Duration
+	layout   string
+	clock    func() time.Time
+	trailer  int
+
+	// Separator and key of the repeated field per level.
+	keys [FatalLevel + 1][]byte
+
+	// The last line written, its level and timestamp position.
+	last []byte
+	lvl  Level
+	ts   [2]int
+
+	n     int
+	timer *time.Timer
+}
+
+// newDeduper returns a deduper writing to l's writer. l must have been
+// set up by New.
+func newDeduper(l *Logger) *deduper {
+	d := &deduper{
+		out:      l.out,
+		errLog:   l.errLog,
+		interval: l.Opts.DedupInterval,
+		layout:   l.Opts.TimestampFormat,
+		clock:    l.Opts.Clock,
+		trailer:  len(l.Opts.LineEnding),
+	}
+	if d.interval <= 0 {
+		d.interval = defaultDedupInterval
+	}
+	if l.Opts.Format == FormatJSON {
+		// The field goes before the closing brace.
+		d.trailer++
+	}
+	for lvl := DebugLevel; lvl <= FatalLevel; lvl++ {
+		d.keys[lvl] = l.encoder(lvl).AppendKey(nil, repeatedKey, false)
+	}
+
+	return d
+}
+
+// write writes the line p unless it's the same as the last one, apart
+// from the timestamp at ts.
+func (d *deduper) write(lvl Level, p []byte, ts [2]int) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.last != nil && lvl == d.lvl && sameLine(d.last, d.ts, p, ts) {
+		if d.n == 0 {
+			d.timer = time.AfterFunc(d.interval, d.flush)
+		}
+		d.n++
+		d.last = append(d.last[:0], p...)
+		d.ts = ts
+		return len(p), nil
+	}
+
+	d.writeRepeated()
+	d.last = append(d.last[:0], p...)
+	d.lvl = lvl
+	d.ts = ts
+	return d.out.writeStamped(lvl, p, ts, d.layout, d.clock)
+}
+
+// flush writes the pending repeats of the last line, if any.
+func (d *deduper) flush() {
+	d.mu.Lock()
+	d.writeRepeated()
+	d.mu.Unlock()
+}
+
+// writeRepeated writes the last line with the number of times it was
+// repeated. d.mu must be held.
+func (d *deduper) writeRepeated() {
+	if d.n == 0 {
+		return
+	}
+	d.timer.Stop()
+
+	buf := bufPool.Get()
+	end := len(d.last) - d.trailer
+	buf.AppendBytes(d.last[:end])
+	buf.AppendBytes(d.keys[d.lvl.orInfo()])
+	buf.AppendInt(int64(d.n))
+	buf.AppendBytes(d.last[end:])
+	d.n = 0
+
+	if _, err := d.out.writeStamped(d.lvl, buf.Bytes(), d.ts, d.layout, d.clock); err != nil {
+		reportWriteError(d.errLog, d.lvl, buf.Bytes(), err)
+	}
+	bufPool.Put(buf)
+}
+
+// sameLine returns true if lines a and b are the same apart from their
+// timestamps at tsA and tsB.
+func sameLine(a []byte, tsA [2]int, b []byte, tsB [2]int) bool {
+	return bytes.Equal(a[:tsA[0]], b[:tsB[0]]) && bytes.Equal(a[tsA[1]:], b[tsB[1]:])
+}
@@ -0,0 +1,78 @@
+package logf
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDedupConsecutive(t *testing.T) {
+	now := time.Date(2022, 7, 7, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time {
+		now = now.Add(time.Second)
+		return now
+	}
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, DedupConsecutive: true, TimestampFormat: time.RFC3339, Clock: clock})
+	for i := 0; i < 5; i++ {
+		l.Info("retrying", "id", 1)
+	}
+	require.Equal(t, "timestamp=2022-07-07T12:00:02Z level=info message=retrying id=1\n", buf.String())
+
+	// A different line writes the last repeat with the count first.
+	l.Info("retrying", "id", 2)
+	l.Warn("retrying", "id", 2)
+	require.Equal(t, "timestamp=2022-07-07T12:00:02Z level=info message=retrying id=1\n"+
+		"timestamp=2022-07-07T12:00:06Z level=info message=retrying id=1 repeated=4\n"+
+		"timestamp=2022-07-07T12:00:07Z level=info message=retrying id=2\n"+
+		"timestamp=2022-07-07T12:00:08Z level=warn message=retrying id=2\n", buf.String())
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Format: FormatJSON, DedupConsecutive: true, TimestampFormat: time.RFC3339, Clock: clock})
+	l.Info("a")
+	l.Info("a")
+	l.Info("b")
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+	require.Contains(t, lines[1], `"message":"a","repeated":1}`)
+	require.Contains(t, lines[2], `"message":"b"}`)
+
+	// Repeats are flushed after the interval without another line.
+	lb := &safeBuffer{}
+	l = New(Opts{Writer: lb, DedupConsecutive: true, DedupInterval: 10 * time.Millisecond})
+	l.Info("idle")
+	l.Info("idle")
+	l.Info("idle")
+	require.Eventually(t, func() bool {
+		return strings.Contains(lb.String(), "message=idle repeated=2\n")
+	}, time.Second, 5*time.Millisecond)
+	require.Equal(t, 2, strings.Count(lb.String(), "\n"))
+}
+
+func TestDedupFlush(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, DedupConsecutive: true, DedupInterval: time.Hour})
+	l.Info("shutting down")
+	l.Info("shutting down")
+	require.Equal(t, 1, strings.Count(buf.String(), "\n"))
+
+	// Flush writes the pending repeats without waiting for the interval.
+	require.NoError(t, l.Flush())
+	require.Contains(t, buf.String(), "message=\"shutting down\" repeated=1\n")
+	require.Equal(t, 2, strings.Count(buf.String(), "\n"))
+
+	// Nothing is pending after.
+	require.NoError(t, l.Flush())
+	require.Equal(t, 2, strings.Count(buf.String(), "\n"))
+
+	// Fatal flushes them too.
+	buf.Reset()
+	l = New(Opts{Writer: buf, DedupConsecutive: true, DedupInterval: time.Hour, ExitFunc: func(int) {}})
+	l.Fatal("retrying")
+	l.Fatal("retrying")
+	require.Contains(t, buf.String(), "level=fatal message=retrying repeated=1\n")
+}
@@ -0,0 +1,50 @@
+package logf
+
+import "reflect"
+
+// Diff returns the fields that changed between two snapshots of
+// key-value pairs, to be passed to With() or a log call:
+//
+//   - Keys in next that aren't in prev, or whose value differs (by
+//     reflect.DeepEqual), are returned with their value in next.
+//   - Keys in prev that aren't in next are returned as "-key" with their
+//     value in prev.
+//   - Keys with the same value in both are left out.
+//
+// Changes come first in the order of next, followed by removals in the
+// order of prev. If a key is repeated, the last value is used, as when
+// logging. A trailing value without a key is ignored.
+func Diff(prev, next []interface{}) []interface{} {
+	var out []interface{}
+	for i := 0; i+1 < len(next); i += 2 {
+		if hasKey(next[i+2:], next[i]) {
+			continue
+		}
+		v, ok := lastValue(prev, next[i])
+		if !ok || !reflect.DeepEqual(v, next[i+1]) {
+			out = append(out, next[i], next[i+1])
+		}
+	}
+
+	for i := 0; i+1 < len(prev); i += 2 {
+		if hasKey(prev[i+2:], prev[i]) {
+			continue
+		}
+		if _, ok := lastValue(next, prev[i]); !ok {
+			key, _ := prev[i].(string)
+			out = append(out, "-"+key, prev[i+1])
+		}
+	}
+
+	return out
+}
+
+// lastValue returns the last value of key in fields.
+func lastValue(fields []interface{}, key interface{}) (interface{}, bool) {
+	for i := len(fields) - len(fields)%2 - 2; i >= 0; i -= 2 {
+		if fields[i] == key {
+			return fields[i+1], true
+		}
+	}
+	return nil, false
+}
@@ -0,0 +1,27 @@
+package logf
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDiff(t *testing.T) {
+	old := []interface{}{"state", "running", "workers", 4, "queue", []int{1, 2}, "region", "in"}
+	new := []interface{}{"workers", 8, "state", "running", "queue", []int{1, 2}, "version", "1.2"}
+
+	require.Equal(t, []interface{}{"workers", 8, "version", "1.2", "-region", "in"}, Diff(old, new))
+	require.Nil(t, Diff(old, old))
+	require.Equal(t, []interface{}{"-state", "running"}, Diff([]interface{}{"state", "running"}, nil))
+	require.Equal(t, []interface{}{"state", "running"}, Diff(nil, []interface{}{"state", "running"}))
+
+	// The last of repeated keys is used, and a trailing value is ignored.
+	require.Equal(t, []interface{}{"a", 3}, Diff([]interface{}{"a", 1, "b"}, []interface{}{"a", 1, "a", 3}))
+	require.Nil(t, Diff([]interface{}{"a", 1, "a", 2}, []interface{}{"a", 2}))
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+	l.With(Diff(old, new)...).Info("state changed")
+	require.Contains(t, buf.String(), `message="state changed" workers=8 version=1.2 -region=in`)
+}
@@ -0,0 +1,544 @@
+package logf
+
+import (
+	"database/sql/driver"
+	"reflect"
+	"runtime"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// Encoder encodes log lines in a custom format, eg: CBOR or msgpack. Set
+// it in Opts.Encoder to use it instead of the built-in formats. Every
+// method appends to dst and returns the extended buffer, like the
+// strconv.Append* functions. An Encoder is used concurrently, so it must
+// not keep per-line state itself. What it needs to finish a line, eg:
+// where the line starts, can be kept in dst instead: the buffer given to
+// BeginLine is either empty or holds only whole lines encoded by the same
+// Encoder.
+//
+// A line is encoded as BeginLine, then AppendKey followed by one of the
+// value methods for every field, and finally EndLine. The fields are the
+// timestamp, level, message (unless it's empty), caller, default fields
+// and the fields passed to the log, in that order. The errors of a
+// multi-error are encoded as key.0, key.1... fields, except by
+// JSONEncoder, which encodes them as an array.
+//
+// The level and default fields are encoded once, when the logger is
+// created, and copied into every line, so their encoding mustn't depend
+// on what comes before them in the line.
+type Encoder interface {
+	BeginLine(dst []byte) []byte
+	// AppendKey appends a key. first is set for the first key of a line.
+	AppendKey(dst []byte, key string, first bool) []byte
+	AppendString(dst []byte, s string) []byte
+	AppendInt(dst []byte, v int64) []byte
+	AppendUint(dst []byte, v uint64) []byte
+	AppendFloat(dst []byte, v float64, bitSize int) []byte
+	AppendBool(dst []byte, v bool) []byte
+	AppendTime(dst []byte, t time.Time) []byte
+	// AppendAny appends values of all other types, including nil.
+	AppendAny(dst []byte, v interface{}) []byte
+	EndLine(dst []byte) []byte
+}
+
+// LogfmtEncoder is the Encoder of FormatLogfmt, and of the fields after
+// the prefix in FormatConsole. Set in Opts.Encoder, it writes logfmt with
+// the default options, eg: without color.
+type LogfmtEncoder struct {
+	// Defaults to the same format as the logger's default.
+	TimestampFormat string
+
+	// The logger's options, for the encoders of the built-in formats, and
+	// the level of the lines for the color of the keys.
+	o   *encoderOpts
+	lvl Level
+}
+
+// JSONEncoder is the Encoder of FormatJSON. Set in Opts.Encoder, it
+// writes JSON with the default options.
+type JSONEncoder struct {
+	// Defaults to the same format as the logger's default.
+	TimestampFormat string
+
+	o   *encoderOpts
+	lvl Level
+}
+
+// encoderOpts are the options of the built-in formats applied by their
+// encoders.
+type encoderOpts struct {
+	esc        escapeOpts
+	sep        string
+	lineEnding string
+
+	// Opts.KnownKeys, escaped once instead of on every line.
+	keys map[string][]byte
+
+	color     bool
+	keyColors map[string]string
+
+	// Opts.BareTimestamp, for logfmt.
+	bareTimestamp bool
+}
+
+// defaultEncoderOpts are the options of encoders set in Opts.Encoder.
+var defaultEncoderOpts = &encoderOpts{
+	esc:        escapeOpts{quote: '"'},
+	sep:        defaultFieldSep,
+	lineEnding: "\n",
+}
+
+// builtinEncoder is implemented by LogfmtEncoder and JSONEncoder. They
+// encode values of all types with AppendAny, and the caller and relative
+// timestamps without building them as strings first, which allocates.
+type builtinEncoder interface {
+	appendCaller(dst []byte, file string, line int) []byte
+	appendRelativeTime(dst []byte, ms float64) []byte
+}
+
+// errorsEncoder is implemented by JSONEncoder, which encodes the errors of
+// a multi-error as an array of strings. They're redacted with redact, if
+// it's set, under key.
+type errorsEncoder interface {
+	appendErrors(dst []byte, key string, errs []error, redact func(key, value string) string) []byte
+}
+
+// builtinEncoders returns the encoders of the logger's format, by level
+// as the color of the keys depends on it.
+func (l *Logger) builtinEncoders() *[FatalLevel + 1]Encoder {
+	o := &encoderOpts{
+		esc:           l.esc,
+		sep:           l.Opts.FieldSeparator,
+		lineEnding:    l.Opts.LineEnding,
+		color:         l.Opts.EnableColor,
+		keyColors:     l.Opts.KeyColors,
+		bareTimestamp: l.Opts.BareTimestamp && l.Opts.Format == FormatLogfmt,
+	}
+	o.keys = o.serializeKnownKeys(l.Opts.KnownKeys, l.Opts.Format == FormatJSON)
+
+	encs := &[FatalLevel + 1]Encoder{}
+	for lvl := DebugLevel; lvl <= FatalLevel; lvl++ {
+		if l.Opts.Format == FormatJSON {
+			encs[lvl] = &JSONEncoder{TimestampFormat: l.Opts.TimestampFormat, o: o, lvl: lvl}
+			continue
+		}
+		encs[lvl] = &LogfmtEncoder{TimestampFormat: l.Opts.TimestampFormat, o: o, lvl: lvl}
+	}
+	return encs
+}
+
+// serializeKnownKeys escapes keys for AppendKey, quoted for JSON.
+func (o *encoderOpts) serializeKnownKeys(keys []string, json bool) map[string][]byte {
+	if len(keys) == 0 {
+		return nil
+	}
+
+	m := make(map[string][]byte, len(keys))
+	for _, key := range keys {
+		buf := &byteBuffer{}
+		if json {
+			writeQuotedString(buf, key, o.esc)
+		} else {
+			escapeAndWriteString(buf, key, o.esc)
+		}
+		m[key] = buf.Bytes()
+	}
+	return m
+}
+
+// keyColor returns the color of key from Opts.KeyColors, or the color of
+// lvl.
+func (o *encoderOpts) keyColor(key string, lvl Level) string {
+	if c, ok := o.keyColors[key]; ok {
+		return c
+	}
+	return levelColor(lvl)
+}
+
+func (e LogfmtEncoder) opts() *encoderOpts {
+	if e.o == nil {
+		return defaultEncoderOpts
+	}
+	return e.o
+}
+
+func (LogfmtEncoder) BeginLine(dst []byte) []byte { return dst }
+
+// AppendKey appends the key followed by the key-value delimiter. With
+// color enabled, the escaped key is wrapped in the level's color so that
+// the ANSI sequences never go through the escaper. With BareTimestamp,
+// the timestamp's key, which is the first, is left out.
+func (e LogfmtEncoder) AppendKey(dst []byte, key string, first bool) []byte {
+	o := e.opts()
+	if first && o.bareTimestamp {
+		return dst
+	}
+
+	buf := byteBuffer{B: dst}
+	if !first {
+		buf.AppendString(o.sep)
+	}
+	if o.color {
+		buf.AppendString(o.keyColor(key, e.lvl))
+	}
+	if b, ok := o.keys[key]; ok {
+		buf.AppendBytes(b)
+	} else {
+		escapeAndWriteString(&buf, key, o.esc)
+	}
+	if o.color {
+		buf.AppendString(reset)
+	}
+	buf.AppendByte('=')
+	return buf.B
+}
+
+func (e LogfmtEncoder) AppendString(dst []byte, s string) []byte {
+	buf := byteBuffer{B: dst}
+	escapeAndWriteString(&buf, s, e.opts().esc)
+	return buf.B
+}
+
+func (LogfmtEncoder) AppendInt(dst []byte, v int64) []byte {
+	buf := byteBuffer{B: dst}
+	buf.AppendInt(v)
+	return buf.B
+}
+
+func (LogfmtEncoder) AppendUint(dst []byte, v uint64) []byte {
+	buf := byteBuffer{B: dst}
+	buf.AppendUint(v)
+	return buf.B
+}
+
+func (e LogfmtEncoder) AppendFloat(dst []byte, v float64, bitSize int) []byte {
+	buf := byteBuffer{B: dst}
+	writeFloatToBuf(&buf, v, bitSize, e.opts().esc)
+	return buf.B
+}
+
+func (LogfmtEncoder) AppendBool(dst []byte, v bool) []byte {
+	buf := byteBuffer{B: dst}
+	buf.AppendBool(v)
+	return buf.B
+}
+
+func (e LogfmtEncoder) AppendTime(dst []byte, t time.Time) []byte {
+	if e.TimestampFormat == "" {
+		return t.AppendFormat(dst, defaultTSFormat)
+	}
+	return t.AppendFormat(dst, e.TimestampFormat)
+}
+
+func (e LogfmtEncoder) AppendAny(dst []byte, v interface{}) []byte {
+	buf := byteBuffer{B: dst}
+	writeValueToBuf(&buf, v, e.opts().esc)
+	return buf.B
+}
+
+func (e LogfmtEncoder) EndLine(dst []byte) []byte { return append(dst, e.opts().lineEnding...) }
+
+func (e LogfmtEncoder) appendCaller(dst []byte, file string, line int) []byte {
+	buf := byteBuffer{B: dst}
+	escapeAndWriteString(&buf, file, e.opts().esc)
+	buf.AppendByte(':')
+	buf.AppendInt(int64(line))
+	return buf.B
+}
+
+func (LogfmtEncoder) appendRelativeTime(dst []byte, ms float64) []byte {
+	return appendMillis(dst, ms)
+}
+
+func (e JSONEncoder) opts() *encoderOpts { return LogfmtEncoder(e).opts() }
+
+func (JSONEncoder) BeginLine(dst []byte) []byte { return append(dst, '{') }
+
+// AppendKey appends the quoted key followed by a colon. JSON keys are
+// never colored.
+func (e JSONEncoder) AppendKey(dst []byte, key string, first bool) []byte {
+	o := e.opts()
+	buf := byteBuffer{B: dst}
+	if !first {
+		buf.AppendByte(',')
+	}
+	if b, ok := o.keys[key]; ok {
+		buf.AppendBytes(b)
+	} else {
+		writeQuotedString(&buf, key, o.esc)
+	}
+	buf.AppendByte(':')
+	return buf.B
+}
+
+func (e JSONEncoder) AppendString(dst []byte, s string) []byte {
+	buf := byteBuffer{B: dst}
+	writeQuotedString(&buf, s, e.opts().esc)
+	return buf.B
+}
+
+func (JSONEncoder) AppendInt(dst []byte, v int64) []byte {
+	return LogfmtEncoder{}.AppendInt(dst, v)
+}
+
+func (JSONEncoder) AppendUint(dst []byte, v uint64) []byte {
+	return LogfmtEncoder{}.AppendUint(dst, v)
+}
+
+func (e JSONEncoder) AppendFloat(dst []byte, v float64, bitSize int) []byte {
+	buf := byteBuffer{B: dst}
+	writeJSONFloatToBuf(&buf, v, bitSize, e.opts().esc)
+	return buf.B
+}
+
+func (JSONEncoder) AppendBool(dst []byte, v bool) []byte {
+	return LogfmtEncoder{}.AppendBool(dst, v)
+}
+
+func (e JSONEncoder) AppendTime(dst []byte, t time.Time) []byte {
+	dst = append(dst, '"')
+	dst = LogfmtEncoder(e).AppendTime(dst, t)
+	return append(dst, '"')
+}
+
+func (e JSONEncoder) AppendAny(dst []byte, v interface{}) []byte {
+	buf := byteBuffer{B: dst}
+	writeJSONValueToBuf(&buf, v, e.opts().esc)
+	return buf.B
+}
+
+func (e JSONEncoder) EndLine(dst []byte) []byte {
+	return append(append(dst, '}'), e.opts().lineEnding...)
+}
+
+func (e JSONEncoder) appendCaller(dst []byte, file string, line int) []byte {
+	buf := byteBuffer{B: dst}
+	buf.AppendByte('"')
+	writeEscapedString(&buf, file, e.opts().esc)
+	buf.AppendByte(':')
+	buf.AppendInt(int64(line))
+	buf.AppendByte('"')
+	return buf.B
+}
+
+func (JSONEncoder) appendRelativeTime(dst []byte, ms float64) []byte {
+	return append(appendMillis(append(dst, '"'), ms), '"')
+}
+
+func (e JSONEncoder) appendErrors(dst []byte, key string, errs []error, redact func(key, value string) string) []byte {
+	buf := byteBuffer{B: dst}
+	buf.AppendByte('[')
+	for i, err := range errs {
+		if i > 0 {
+			buf.AppendByte(',')
+		}
+		if err == nil {
+			buf.AppendString("null")
+			continue
+		}
+
+		s := errorValue(err)
+		if redact != nil {
+			s = redact(key, s)
+		}
+		writeQuotedString(&buf, s, e.opts().esc)
+	}
+	buf.AppendByte(']')
+	return buf.B
+}
+
+// encoder returns Opts.Encoder, or the encoder of the built-in format for
+// lines at lvl.
+func (l *Logger) encoder(lvl Level) Encoder {
+	if l.Opts.Encoder != nil {
+		return l.Opts.Encoder
+	}
+	return l.encs[lvl]
+}
+
+// encodeTimestamp encodes the timestamp field and returns the position of
+// the timestamp in b. It's only known for the built-in formats, which
+// write it as is, quoted in JSON.
+func (l *Logger) encodeTimestamp(enc Encoder, b []byte, fields []interface{}) ([]byte, [2]int) {
+	var ts [2]int
+	b = enc.AppendKey(b, tsKey, true)
+
+	if v, ok := l.userTimestamp(fields); ok {
+		if t, ok := v.(time.Time); ok {
+			return enc.AppendTime(b, t), ts
+		}
+		return l.encodeValue(enc, b, v), ts
+	}
+
+	// Relative timestamps have no position as they can't be replaced with
+	// a TimestampFormat.
+	if l.Opts.RelativeTimestamps {
+		if be, ok := enc.(builtinEncoder); ok {
+			return be.appendRelativeTime(b, l.relativeTime()), ts
+		}
+		return enc.AppendString(b, string(appendMillis(nil, l.relativeTime()))), ts
+	}
+
+	start := len(b)
+	b = enc.AppendTime(b, l.now())
+	switch {
+	case l.Opts.Encoder != nil:
+	case l.Opts.Format == FormatJSON:
+		ts = [2]int{start + 1, len(b) - 1}
+	default:
+		ts = [2]int{start, len(b)}
+	}
+	return b, ts
+}
+
+// encodeCaller encodes the caller fields. depth is the number of frames
+// to skip to get to the caller, like in writeLineToBuf.
+func (l *Logger) encodeCaller(enc Encoder, b []byte, depth int, lvl Level) []byte {
+	switch {
+	case l.caller != "":
+		b = enc.AppendKey(b, "caller", false)
+		return enc.AppendString(b, l.caller)
+	case !l.Opts.EnableCaller || lvl < l.Opts.CallerMinLevel:
+		return b
+	case l.Opts.StructuredCaller:
+		file, line, fn := callerFrame(depth)
+		b = enc.AppendKey(b, callerFileKey, false)
+		b = enc.AppendString(b, file)
+		b = enc.AppendKey(b, callerLineKey, false)
+		b = enc.AppendInt(b, int64(line))
+		b = enc.AppendKey(b, callerFuncKey, false)
+		return enc.AppendString(b, fn)
+	}
+
+	_, file, line, ok := runtime.Caller(depth)
+	if !ok {
+		file = "???"
+		line = 0
+	}
+
+	b = enc.AppendKey(b, "caller", false)
+	if be, ok := enc.(builtinEncoder); ok {
+		return be.appendCaller(b, file, line)
+	}
+	cb := byteBuffer{B: append([]byte(file), ':')}
+	cb.AppendInt(int64(line))
+	return enc.AppendString(b, string(cb.B))
+}
+
+// encodeSeq encodes the sequence number, with Opts.Sequence.
+func (l *Logger) encodeSeq(enc Encoder, b []byte) []byte {
+	if l.seq == nil {
+		return b
+	}
+	b = enc.AppendKey(b, seqKey, false)
+	return enc.AppendUint(b, atomic.AddUint64(l.seq, 1))
+}
+
+// encodeField encodes a user provided field, applying the KeyTransformer
+// and ValueRedactor if set.
+func (l *Logger) encodeField(enc Encoder, b []byte, key string, val interface{}) []byte {
+	if v, ok := val.(driver.Valuer); ok {
+		val = valuerValue(v)
+	}
+
+	// The errors of a multi-error are encoded instead of the newline
+	// separated string of its Error().
+	if errs, ok := joinedErrors(val); ok {
+		if ee, ok := enc.(errorsEncoder); ok {
+			if l.KeyTransformer != nil {
+				key = l.KeyTransformer(key)
+			}
+			b = enc.AppendKey(b, key, false)
+			return ee.appendErrors(b, key, errs, l.ValueRedactor)
+		}
+
+		for i, err := range errs {
+			b = l.encodeField(enc, b, key+"."+strconv.Itoa(i), err)
+		}
+		return b
+	}
+
+	if l.Opts.FlattenStructs {
+		if v, ok := structValue(val); ok {
+			return l.encodeStruct(enc, b, key, v)
+		}
+	}
+
+	if l.KeyTransformer != nil {
+		key = l.KeyTransformer(key)
+	}
+
+	if l.ValueRedactor != nil {
+		if s, ok := stringValue(val); ok {
+			val = l.ValueRedactor(key, s)
+		}
+	}
+
+	b = enc.AppendKey(b, key, false)
+	return l.encodeValue(enc, b, val)
+}
+
+// encodeStruct encodes the fields of a struct as separate fields. A struct
+// without any fields to encode is encoded as a regular value.
+func (l *Logger) encodeStruct(enc Encoder, b []byte, key string, v reflect.Value) []byte {
+	// The flattened values are encoded as is, so that structs left over
+	// at the maximum depth aren't flattened again.
+	nl := *l
+	nl.Opts.FlattenStructs = false
+
+	pairs := flattenStruct(nil, key, v, 0)
+	if len(pairs) == 0 {
+		return nl.encodeField(enc, b, key, v.Interface())
+	}
+
+	for i := 1; i < len(pairs); i += 2 {
+		b = nl.encodeField(enc, b, pairs[i-1].(string), pairs[i])
+	}
+	return b
+}
+
+// encodeValue encodes a value with the Encoder method for its type.
+func (l *Logger) encodeValue(enc Encoder, b []byte, val interface{}) []byte {
+	if _, ok := enc.(builtinEncoder); ok {
+		return enc.AppendAny(b, val)
+	}
+
+	switch v := val.(type) {
+	case []byte:
+		return enc.AppendString(b, string(v))
+	case string:
+		return enc.AppendString(b, v)
+	case int:
+		return enc.AppendInt(b, int64(v))
+	case int8:
+		return enc.AppendInt(b, int64(v))
+	case int16:
+		return enc.AppendInt(b, int64(v))
+	case int32:
+		return enc.AppendInt(b, int64(v))
+	case int64:
+		return enc.AppendInt(b, v)
+	case uint:
+		return enc.AppendUint(b, uint64(v))
+	case uint8:
+		return enc.AppendUint(b, uint64(v))
+	case uint16:
+		return enc.AppendUint(b, uint64(v))
+	case uint32:
+		return enc.AppendUint(b, uint64(v))
+	case uint64:
+		return enc.AppendUint(b, v)
+	case float32:
+		return enc.AppendFloat(b, float64(v), 32)
+	case float64:
+		return enc.AppendFloat(b, v, 64)
+	case bool:
+		return enc.AppendBool(b, v)
+	case error:
+		return enc.AppendString(b, errorValue(v))
+	default:
+		return enc.AppendAny(b, val)
+	}
+}
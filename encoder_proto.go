@@ -0,0 +1,260 @@
+package logf
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// Protobuf wire types.
+const (
+	protoVarint  = 0
+	protoFixed64 = 1
+	protoBytes   = 2
+)
+
+// Field numbers of Record, Field and Value in logf.proto.
+const (
+	protoTimestamp = 1
+	protoFields    = 6
+
+	protoFieldKey   = 1
+	protoFieldValue = 2
+
+	protoString = 1
+	protoInt    = 2
+	protoUint   = 3
+	protoFloat  = 4
+	protoBool   = 5
+)
+
+// Record fields of the keys that have one, the rest go in Record.fields.
+var protoRecordFields = map[string]int{
+	"level":   2,
+	"message": 3,
+	scopeKey:  4,
+	"caller":  5,
+}
+
+// protoLenSize is the size of the length prefixes of records and their
+// fields. They're written as varints padded to a fixed size so that they
+// can be filled in once the record is complete.
+const protoLenSize = 5
+
+// ProtoEncoder is an Encoder that writes every line as a protobuf Record
+// message, defined in logf.proto, prefixed with its length as a varint,
+// eg: for readers like protodelim. Timestamps are written as Unix
+// nanoseconds and values other than strings, numbers and bools as
+// strings. Invalid UTF-8 in keys and strings is replaced with U+FFFD.
+// With NumericLevel, the level is written to Record.fields.
+//
+// Every field is written as a Record.fields entry, and EndLine moves the
+// ones with their own Record field there. Length prefixes are padded to 5
+// bytes, which protobuf decoders accept. EndLine finds where the record
+// starts by skipping over the whole records before it in the buffer, as
+// allowed by Encoder.
+type ProtoEncoder struct{}
+
+func (ProtoEncoder) BeginLine(dst []byte) []byte {
+	// A zero length marks the record being written.
+	return appendPaddedZero(dst)
+}
+
+// AppendKey appends a Record.fields entry with the key and a zero length,
+// which is filled in by EndLine.
+func (ProtoEncoder) AppendKey(dst []byte, key string, first bool) []byte {
+	key = validUTF8(key)
+	dst = appendPaddedZero(append(dst, protoTag(protoFields, protoBytes)))
+	dst = appendProtoString(dst, protoFieldKey, len(key))
+	return append(dst, key...)
+}
+
+func (ProtoEncoder) AppendString(dst []byte, s string) []byte {
+	s = validUTF8(s)
+	dst = appendProtoString(dst, protoFieldValue, 1+varintSize(uint64(len(s)))+len(s))
+	dst = appendProtoString(dst, protoString, len(s))
+	return append(dst, s...)
+}
+
+func (ProtoEncoder) AppendInt(dst []byte, v int64) []byte {
+	return appendProtoVarint(dst, protoInt, uint64(v))
+}
+
+func (ProtoEncoder) AppendUint(dst []byte, v uint64) []byte {
+	return appendProtoVarint(dst, protoUint, v)
+}
+
+func (ProtoEncoder) AppendFloat(dst []byte, v float64, bitSize int) []byte {
+	dst = append(dst, protoTag(protoFieldValue, protoBytes), 9, protoTag(protoFloat, protoFixed64))
+
+	var b [8]byte
+	binary.LittleEndian.PutUint64(b[:], math.Float64bits(v))
+	return append(dst, b[:]...)
+}
+
+func (ProtoEncoder) AppendBool(dst []byte, v bool) []byte {
+	b := byte(0)
+	if v {
+		b = 1
+	}
+	return append(dst, protoTag(protoFieldValue, protoBytes), 2, protoTag(protoBool, protoVarint), b)
+}
+
+// AppendTime appends the time as Unix nanoseconds. EndLine moves the
+// timestamp field to Record.timestamp.
+func (e ProtoEncoder) AppendTime(dst []byte, t time.Time) []byte {
+	return e.AppendInt(dst, t.UnixNano())
+}
+
+func (e ProtoEncoder) AppendAny(dst []byte, v interface{}) []byte {
+	switch val := v.(type) {
+	case nil:
+		// An empty Value.
+		return append(dst, protoTag(protoFieldValue, protoBytes), 0)
+	case Raw:
+		return e.AppendString(dst, string(val))
+	case complex64, complex128:
+		return e.AppendString(dst, fmt.Sprintf("%v", val))
+	}
+
+	s, _ := stringValue(v)
+	return e.AppendString(dst, s)
+}
+
+// EndLine fills in the lengths of the record being written, which is the
+// one with a zero length, and of its fields. The timestamp, if it's the
+// first field, and string values of keys with their own Record field are
+// moved there, which only ever shrinks the record.
+func (ProtoEncoder) EndLine(dst []byte) []byte {
+	start := 0
+	for start+protoLenSize <= len(dst) {
+		n, _ := binary.Uvarint(dst[start : start+protoLenSize])
+		if n == 0 {
+			break
+		}
+		start += protoLenSize + int(n)
+	}
+	if start+protoLenSize > len(dst) {
+		return dst
+	}
+
+	var (
+		r = start + protoLenSize
+		w = r
+	)
+	for first := true; r < len(dst); first = false {
+		key, val, end, ok := protoEntry(dst, r)
+		if !ok {
+			// Not written by AppendKey and a value method. Leave the
+			// rest as is.
+			w += copy(dst[w:], dst[r:])
+			break
+		}
+
+		num, ok := protoRecordFields[string(key)]
+		switch {
+		case ok && len(val) > 0 && val[0] == protoTag(protoString, protoBytes):
+			// The Value's string_value has the same length prefix as the
+			// Record field.
+			dst[w] = protoTag(num, protoBytes)
+			w += 1 + copy(dst[w+1:], val[1:])
+		case first && string(key) == tsKey && len(val) > 0 && val[0] == protoTag(protoInt, protoVarint):
+			dst[w] = protoTag(protoTimestamp, protoVarint)
+			w += 1 + copy(dst[w+1:], val[1:])
+		default:
+			putPaddedVarint(dst[r+1:r+1+protoLenSize], uint64(end-r-1-protoLenSize))
+			w += copy(dst[w:], dst[r:end])
+		}
+		r = end
+	}
+
+	putPaddedVarint(dst[start:start+protoLenSize], uint64(w-start-protoLenSize))
+	return dst[:w]
+}
+
+// protoEntry returns the key and the Value message of the Record.fields
+// entry at dst[i:], and the end of the entry.
+func protoEntry(dst []byte, i int) (key, val []byte, end int, ok bool) {
+	if dst[i] != protoTag(protoFields, protoBytes) {
+		return nil, nil, 0, false
+	}
+	i += 1 + protoLenSize
+
+	key, i, ok = protoSubfield(dst, i, protoFieldKey)
+	if !ok {
+		return nil, nil, 0, false
+	}
+	val, i, ok = protoSubfield(dst, i, protoFieldValue)
+	return key, val, i, ok
+}
+
+// protoSubfield returns the bytes of the length delimited field num at
+// dst[i:] and its end.
+func protoSubfield(dst []byte, i, num int) ([]byte, int, bool) {
+	if i >= len(dst) || dst[i] != protoTag(num, protoBytes) {
+		return nil, 0, false
+	}
+	n, w := binary.Uvarint(dst[i+1:])
+	if w <= 0 || n > uint64(len(dst)-i-1-w) {
+		return nil, 0, false
+	}
+	i += 1 + w
+	return dst[i : i+int(n)], i + int(n), true
+}
+
+func protoTag(num, typ int) byte {
+	return byte(num<<3 | typ)
+}
+
+// appendProtoString appends the tag and length of a string field.
+func appendProtoString(dst []byte, num, n int) []byte {
+	return appendVarint(append(dst, protoTag(num, protoBytes)), uint64(n))
+}
+
+// appendProtoVarint appends a Value with the varint field num.
+func appendProtoVarint(dst []byte, num int, v uint64) []byte {
+	dst = append(dst, protoTag(protoFieldValue, protoBytes), byte(1+varintSize(v)), protoTag(num, protoVarint))
+	return appendVarint(dst, v)
+}
+
+// appendPaddedZero appends a zero length padded to protoLenSize bytes.
+func appendPaddedZero(dst []byte) []byte {
+	return append(dst, 0x80, 0x80, 0x80, 0x80, 0)
+}
+
+// putPaddedVarint writes v to b as a varint padded to len(b) bytes.
+func putPaddedVarint(b []byte, v uint64) {
+	for i := range b {
+		b[i] = byte(v&0x7f) | 0x80
+		v >>= 7
+	}
+	b[len(b)-1] &= 0x7f
+}
+
+// validUTF8 replaces invalid UTF-8 in s with U+FFFD, as protobuf strings
+// must be valid UTF-8.
+func validUTF8(s string) string {
+	if utf8.ValidString(s) {
+		return s
+	}
+	return strings.ToValidUTF8(s, "\uFFFD")
+}
+
+func appendVarint(dst []byte, v uint64) []byte {
+	for v >= 0x80 {
+		dst = append(dst, byte(v)|0x80)
+		v >>= 7
+	}
+	return append(dst, byte(v))
+}
+
+func varintSize(v uint64) int {
+	size := 1
+	for ; v >= 0x80; v >>= 7 {
+		size++
+	}
+	return size
+}
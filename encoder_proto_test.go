@@ -0,0 +1,237 @@
+package logf
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// protoRecord is a decoded Record of logf.proto.
+type protoRecord struct {
+	Timestamp int64
+	Level     string
+	Message   string
+	Scope     string
+	Caller    string
+	Fields    []protoKV
+}
+
+type protoKV struct {
+	Key   string
+	Value interface{}
+}
+
+// decodeProto decodes length prefixed Records.
+func decodeProto(b []byte) ([]protoRecord, error) {
+	var out []protoRecord
+	for len(b) > 0 {
+		n, w := binary.Uvarint(b)
+		if w <= 0 || uint64(len(b)-w) < n {
+			return nil, errors.New("bad record length")
+		}
+
+		var r protoRecord
+		err := decodeProtoMessage(b[w:w+int(n)], func(num int, v uint64, p []byte) error {
+			switch num {
+			case 1:
+				r.Timestamp = int64(v)
+			case 2:
+				r.Level = string(p)
+			case 3:
+				r.Message = string(p)
+			case 4:
+				r.Scope = string(p)
+			case 5:
+				r.Caller = string(p)
+			case 6:
+				var kv protoKV
+				err := decodeProtoMessage(p, func(num int, _ uint64, p []byte) error {
+					if num == 1 {
+						kv.Key = string(p)
+						return nil
+					}
+					return decodeProtoMessage(p, func(num int, v uint64, p []byte) error {
+						switch num {
+						case 1:
+							kv.Value = string(p)
+						case 2:
+							kv.Value = int64(v)
+						case 3:
+							kv.Value = v
+						case 4:
+							kv.Value = math.Float64frombits(v)
+						case 5:
+							kv.Value = v == 1
+						}
+						return nil
+					})
+				})
+				if err != nil {
+					return err
+				}
+				r.Fields = append(r.Fields, kv)
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		out = append(out, r)
+		b = b[w+int(n):]
+	}
+	return out, nil
+}
+
+// decodeProtoMessage calls fn with the number and the value of every field,
+// v for varint and fixed64 fields and p for length delimited ones.
+func decodeProtoMessage(b []byte, fn func(num int, v uint64, p []byte) error) error {
+	for len(b) > 0 {
+		tag, w := binary.Uvarint(b)
+		if w <= 0 {
+			return errors.New("bad tag")
+		}
+		b = b[w:]
+
+		var (
+			v uint64
+			p []byte
+		)
+		switch tag & 7 {
+		case protoVarint:
+			v, w = binary.Uvarint(b)
+			if w <= 0 {
+				return errors.New("bad varint")
+			}
+			b = b[w:]
+		case protoFixed64:
+			if len(b) < 8 {
+				return errors.New("bad fixed64")
+			}
+			v, b = binary.LittleEndian.Uint64(b), b[8:]
+		case protoBytes:
+			n, w := binary.Uvarint(b)
+			if w <= 0 || uint64(len(b)-w) < n {
+				return errors.New("bad length")
+			}
+			p, b = b[w:w+int(n)], b[w+int(n):]
+		default:
+			return errors.New("bad wire type")
+		}
+
+		if err := fn(int(tag>>3), v, p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestProtoEncoder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{
+		Writer: buf, Encoder: ProtoEncoder{}, Clock: func() time.Time { return time.Unix(0, 1500) },
+		DefaultFields: []interface{}{scopeKey, "db"},
+	})
+
+	l.Error("query failed", "rows", 3, "ok", true, "took", 1.5, "err", "bad\xff", "nil", nil, "k\xff", 1)
+	l.WriteEntries([]Entry{{Level: WarnLevel, Message: "two"}})
+
+	// Length prefixes are padded to 5 bytes.
+	golden := []byte{
+		0x83, 0x81, 0x80, 0x80, 0x00, // Record, 131 bytes.
+		0x08, 0xdc, 0x0b, // timestamp: 1500
+		0x12, 0x05, 'e', 'r', 'r', 'o', 'r', // level: "error"
+		0x1a, 0x0c, 'q', 'u', 'e', 'r', 'y', ' ', 'f', 'a', 'i', 'l', 'e', 'd', // message: "query failed"
+		0x22, 0x02, 'd', 'b', // scope: "db"
+
+		// fields: {"rows": {int_value: 3}}
+		0x32, 0x8a, 0x80, 0x80, 0x80, 0x00,
+		0x0a, 0x04, 'r', 'o', 'w', 's',
+		0x12, 0x02, 0x10, 0x03,
+
+		// fields: {"ok": {bool_value: true}}
+		0x32, 0x88, 0x80, 0x80, 0x80, 0x00,
+		0x0a, 0x02, 'o', 'k',
+		0x12, 0x02, 0x28, 0x01,
+
+		// fields: {"took": {float_value: 1.5}}
+		0x32, 0x91, 0x80, 0x80, 0x80, 0x00,
+		0x0a, 0x04, 't', 'o', 'o', 'k',
+		0x12, 0x09, 0x21, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0xf8, 0x3f,
+
+		// fields: {"err": {string_value: "bad\uFFFD"}}
+		0x32, 0x8f, 0x80, 0x80, 0x80, 0x00,
+		0x0a, 0x03, 'e', 'r', 'r',
+		0x12, 0x08, 0x0a, 0x06, 'b', 'a', 'd', 0xef, 0xbf, 0xbd,
+
+		// fields: {"nil": {}}
+		0x32, 0x87, 0x80, 0x80, 0x80, 0x00,
+		0x0a, 0x03, 'n', 'i', 'l',
+		0x12, 0x00,
+
+		// fields: {"k\uFFFD": {int_value: 1}}
+		0x32, 0x8a, 0x80, 0x80, 0x80, 0x00,
+		0x0a, 0x04, 'k', 0xef, 0xbf, 0xbd,
+		0x12, 0x02, 0x10, 0x01,
+
+		0x92, 0x80, 0x80, 0x80, 0x00, // Record, 18 bytes.
+		0x08, 0xdc, 0x0b, // timestamp: 1500
+		0x12, 0x04, 'w', 'a', 'r', 'n', // level: "warn"
+		0x1a, 0x03, 't', 'w', 'o', // message: "two"
+		0x22, 0x02, 'd', 'b', // scope: "db"
+	}
+	require.Equal(t, golden, buf.Bytes())
+}
+
+func TestProtoEncoderNumericLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Encoder: ProtoEncoder{}, NumericLevel: true, Clock: func() time.Time { return time.Unix(0, 1) }})
+	l.Info("")
+
+	golden := []byte{
+		0x93, 0x80, 0x80, 0x80, 0x00, // Record, 19 bytes.
+		0x08, 0x01, // timestamp: 1
+
+		// fields: {"level": {int_value: 2}}
+		0x32, 0x8b, 0x80, 0x80, 0x80, 0x00,
+		0x0a, 0x05, 'l', 'e', 'v', 'e', 'l',
+		0x12, 0x02, 0x10, 0x02,
+	}
+	require.Equal(t, golden, buf.Bytes())
+}
+
+func TestProtoEncoderRoundTrip(t *testing.T) {
+	ts := time.Date(2022, 7, 7, 12, 0, 0, 500, time.UTC)
+	buf := &bytes.Buffer{}
+	l := New(Opts{
+		Writer: buf, Encoder: ProtoEncoder{}, EnableCaller: true, Clock: func() time.Time { return ts },
+		DefaultFields: []interface{}{scopeKey, "db"},
+	})
+
+	l.Error("query failed", "rows", 3, "ok", false, "took", 1.5, "big", uint64(math.MaxUint64), "err", errors.New("timeout"), "nil", nil)
+	l.WriteEntries([]Entry{{Level: InfoLevel, Message: "one"}, {Level: WarnLevel, Message: "two", Fields: []interface{}{"id", "a"}}})
+
+	recs, err := decodeProto(buf.Bytes())
+	require.NoError(t, err)
+	require.Len(t, recs, 3)
+
+	r := recs[0]
+	require.Equal(t, ts.UnixNano(), r.Timestamp)
+	require.Equal(t, "error", r.Level)
+	require.Equal(t, "query failed", r.Message)
+	require.Equal(t, "db", r.Scope)
+	require.Regexp(t, `encoder_proto_test.go:\d+$`, r.Caller)
+	require.Equal(t, []protoKV{
+		{"rows", int64(3)}, {"ok", false}, {"took", 1.5}, {"big", uint64(math.MaxUint64)}, {"err", "timeout"}, {"nil", nil},
+	}, r.Fields)
+
+	require.Equal(t, "one", recs[1].Message)
+	require.Empty(t, recs[1].Fields)
+	require.Equal(t, "warn", recs[2].Level)
+	require.Equal(t, []protoKV{{"id", "a"}}, recs[2].Fields)
+}
@@ -0,0 +1,127 @@
+package logf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// pipeEncoder writes lines as key:value pairs separated by pipes, without
+// the timestamp value.
+type pipeEncoder struct{}
+
+func (pipeEncoder) BeginLine(dst []byte) []byte { return append(dst, '[') }
+
+func (pipeEncoder) AppendKey(dst []byte, key string, first bool) []byte {
+	if !first {
+		dst = append(dst, '|')
+	}
+	return append(append(dst, key...), ':')
+}
+
+func (pipeEncoder) AppendString(dst []byte, s string) []byte { return append(dst, s...) }
+func (pipeEncoder) AppendInt(dst []byte, v int64) []byte     { return strconv.AppendInt(dst, v, 10) }
+func (pipeEncoder) AppendUint(dst []byte, v uint64) []byte   { return strconv.AppendUint(dst, v, 10) }
+func (pipeEncoder) AppendBool(dst []byte, v bool) []byte     { return strconv.AppendBool(dst, v) }
+func (pipeEncoder) AppendTime(dst []byte, t time.Time) []byte {
+	return append(dst, '-')
+}
+func (pipeEncoder) AppendAny(dst []byte, v interface{}) []byte { return append(dst, '?') }
+func (pipeEncoder) EndLine(dst []byte) []byte                  { return append(dst, ']', '\n') }
+
+func (pipeEncoder) AppendFloat(dst []byte, v float64, bitSize int) []byte {
+	return strconv.AppendFloat(dst, v, 'f', -1, bitSize)
+}
+
+func TestCustomEncoder(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Encoder: pipeEncoder{}, DefaultFields: []interface{}{"service", "api"}})
+
+	l.Info("hello world", "count", 3, "ratio", 0.5, "ok", true, "size", uint(7), "list", []int{1}, "odd")
+	require.Equal(t, "[timestamp:-|level:info|message:hello world|service:api|count:3|ratio:0.5|ok:true|size:7|list:?|!BADKEY:odd]\n", buf.String())
+	buf.Reset()
+
+	// Call fields override default fields.
+	l.Error("oops", "service", "db")
+	require.Equal(t, "[timestamp:-|level:error|message:oops|service:db]\n", buf.String())
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Encoder: pipeEncoder{}, EnableCaller: true, NumericLevel: true})
+	l.Warn("")
+	require.Regexp(t, `^\[timestamp:-\|level:3\|caller:\S+/encoder_test.go:\d+\]\n$`, buf.String())
+	buf.Reset()
+
+	// Entries and Encode use the encoder too.
+	l.WriteEntries([]Entry{{Level: InfoLevel, Message: "first"}, {Level: InfoLevel, Message: "second"}})
+	require.Regexp(t, `^\[timestamp:-\|level:2\|message:first\|caller:\S+/encoder_test.go:\d+\]\n\[timestamp:-\|level:2\|message:second\|caller:\S+/encoder_test.go:\d+\]\n$`, buf.String())
+	require.Regexp(t, `^\[timestamp:-\|level:2\|message:hi\|caller:\S+/encoder_test.go:\d+\]\n$`, string(l.Encode(InfoLevel, "hi")))
+}
+
+func TestBuiltinEncoders(t *testing.T) {
+	// The built-in encoders write the same lines as the built-in formats.
+	for _, c := range []struct {
+		enc    Encoder
+		format Format
+	}{
+		{LogfmtEncoder{TimestampFormat: "2006"}, FormatLogfmt},
+		{JSONEncoder{TimestampFormat: "2006"}, FormatJSON},
+	} {
+		a, b := &bytes.Buffer{}, &bytes.Buffer{}
+		fields := []interface{}{"str", "a b", "int", -1, "float", 1.5, "bool", false, "err", errors.New("oops"), "nil", nil, "map", map[string]int{"a": 1}}
+
+		New(Opts{Writer: a, Encoder: c.enc, DefaultFields: []interface{}{"service", "api"}}).Info("hello world", fields...)
+		New(Opts{Writer: b, Format: c.format, TimestampFormat: "2006", DefaultFields: []interface{}{"service", "api"}}).Info("hello world", fields...)
+		require.Equal(t, b.String(), a.String())
+	}
+
+	buf := &bytes.Buffer{}
+	New(Opts{Writer: buf, Encoder: JSONEncoder{}}).Info("hello", "key", "val")
+	var out map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &out))
+	require.Equal(t, "val", out["key"])
+}
+
+func TestEncoderParity(t *testing.T) {
+	// The Encoder path honors the same options as the built-in formats.
+	ts := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := func() time.Time { return ts }
+
+	for _, c := range []struct {
+		name   string
+		opts   Opts
+		fields []interface{}
+	}{
+		{"joined errors", Opts{}, []interface{}{"error", multiErr{errors.New("a"), errors.New("b c")}}},
+		{"flatten structs", Opts{FlattenStructs: true}, []interface{}{"user", user{ID: 1, Name: "x", Address: address{City: "y"}}}},
+		{"timestamp from fields", Opts{TimestampFromFields: true}, []interface{}{"a", 1, "timestamp", ts.Add(time.Hour)}},
+		{"timestamp from fields, not a time", Opts{TimestampFromFields: true}, []interface{}{"timestamp", "yesterday"}},
+		{"relative timestamps", Opts{RelativeTimestamps: true}, nil},
+		{"structured caller", Opts{EnableCaller: true, StructuredCaller: true}, nil},
+		{"repeated keys", Opts{DefaultFields: []interface{}{"a", 0}}, []interface{}{"a", 1, "b", 2, "a", 3}},
+		{"redacted", Opts{ValueRedactor: func(k, v string) string { return "***" }}, []interface{}{"a", "secret"}},
+	} {
+		for _, f := range []struct {
+			enc    Encoder
+			format Format
+		}{
+			{LogfmtEncoder{TimestampFormat: time.RFC3339}, FormatLogfmt},
+			{JSONEncoder{TimestampFormat: time.RFC3339}, FormatJSON},
+		} {
+			a, b := &bytes.Buffer{}, &bytes.Buffer{}
+			eo, fo := c.opts, c.opts
+			eo.Writer, eo.Clock, eo.Encoder = a, clock, f.enc
+			fo.Writer, fo.Clock, fo.Format, fo.TimestampFormat = b, clock, f.format, time.RFC3339
+
+			el, fl := New(eo), New(fo)
+			for _, l := range []Logger{el, fl} {
+				l.Info("hello", c.fields...)
+			}
+			require.Equal(t, b.String(), a.String(), c.name)
+		}
+	}
+}
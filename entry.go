@@ -0,0 +1,56 @@
+package logf
+
+// Entry is a pre-built log entry that can be written in bulk with
+// WriteEntries.
+type Entry struct {
+	Level   Level
+	Message string
+
+	// Fields as key-value pairs, as passed to the Debug/Info/... methods.
+	Fields []interface{}
+}
+
+// WriteEntries serializes the entries that pass the level filter into a
+// single buffer and writes it with one Write, amortizing locking and
+// syscalls when writing many entries at once. The caller, if enabled, is
+// the caller of WriteEntries. Fatal entries don't abort the program and
+// entries with invalid levels are written at InfoLevel.
+func (l Logger) WriteEntries(entries []Entry) {
+	var (
+		buf = bufPool.Get()
+		max Level
+
+		// Entries for Opts.AlertHook once they're written.
+		alerts []Entry
+	)
+
+	for _, e := range entries {
+		e.Level = e.Level.orInfo()
+		ok, dropped := l.filter(e.Level, e.Message, e.Fields)
+		if !ok {
+			continue
+		}
+
+		l.writeLineToBuf(buf, e.Message, e.Level, dropped, l.Opts.CallerSkipFrameCount, e.Fields)
+		if e.Level > max {
+			max = e.Level
+		}
+		if l.Opts.AlertHook != nil && e.Level >= l.Opts.AlertLevel {
+			alerts = append(alerts, e)
+		}
+	}
+
+	// LevelWriters see the most severe level in the batch.
+	if len(buf.Bytes()) > 0 {
+		if _, err := l.out.WriteLevel(max, buf.Bytes()); err != nil {
+			// Should ideally never happen.
+			reportWriteError(l.errLog, max, buf.Bytes(), err)
+		}
+	}
+
+	for _, e := range alerts {
+		l.alert(e.Level, e.Message, e.Fields)
+	}
+
+	bufPool.Put(buf)
+}
@@ -0,0 +1,74 @@
+package logf
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// countingWriter counts the number of writes.
+type countingWriter struct {
+	bytes.Buffer
+	writes int
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.writes++
+	return w.Buffer.Write(p)
+}
+
+func TestWriteEntries(t *testing.T) {
+	w := &countingWriter{}
+	l := New(Opts{Writer: w, EnableCaller: true, DefaultFields: []interface{}{"service", "api"}})
+
+	l.WriteEntries([]Entry{
+		{Level: InfoLevel, Message: "first", Fields: []interface{}{"index", 1}},
+		{Level: DebugLevel, Message: "filtered"},
+		{Level: ErrorLevel, Message: "second", Fields: []interface{}{"index", 2, "odd"}},
+	})
+
+	require.Equal(t, 1, w.writes, "entries should be written at once")
+	lines := strings.Split(strings.TrimSuffix(w.String(), "\n"), "\n")
+	require.Len(t, lines, 2)
+	require.Regexp(t, `level=info message=first caller=\S+/entry_test.go:\d+ service=api index=1$`, lines[0])
+	require.Regexp(t, `level=error message=second caller=\S+/entry_test.go:\d+ service=api index=2 !BADKEY=odd$`, lines[1])
+
+	// Nothing is written if every entry is filtered.
+	w = &countingWriter{}
+	l = New(Opts{Writer: w})
+	l.WriteEntries([]Entry{{Level: DebugLevel, Message: "filtered"}})
+	l.WriteEntries(nil)
+	require.Equal(t, 0, w.writes)
+}
+
+func TestWriteEntriesLevelWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewBufferedWriter(buf, BufferedOpts{})
+	l := New(Opts{Writer: w})
+
+	// The batch is flushed as it contains an error.
+	l.WriteEntries([]Entry{{Level: InfoLevel, Message: "first"}, {Level: ErrorLevel, Message: "second"}})
+	require.Equal(t, 2, strings.Count(buf.String(), "\n"))
+}
+
+func TestEncode(t *testing.T) {
+	w := &countingWriter{}
+	l := New(Opts{Writer: w, EnableCaller: true, DefaultFields: []interface{}{"service", "api"}})
+
+	b := l.Encode(DebugLevel, "hello world", "key", "val")
+	require.Equal(t, 0, w.writes, "nothing should be written")
+	require.Regexp(t, `^timestamp=\S+ level=debug message="hello world" caller=\S+/entry_test.go:\d+ service=api key=val\n$`, string(b))
+
+	// The bytes are safe to retain after more logging.
+	first := string(b)
+	for i := 0; i < 10; i++ {
+		l.Encode(InfoLevel, "other line")
+	}
+	require.Equal(t, first, string(b))
+
+	// Formatting options are honored.
+	l = New(Opts{Writer: w, Format: FormatJSON})
+	require.Regexp(t, `^\{"timestamp":"\S+","level":"info","message":"hello world","key":1\}\n$`, string(l.Encode(InfoLevel, "hello world", "key", 1)))
+}
@@ -0,0 +1,106 @@
+//go:build windows
+// +build windows
+
+package logf
+
+import (
+	"bytes"
+	"sync"
+	"syscall"
+	"unsafe"
+)
+
+// Event types of ReportEvent.
+const (
+	eventlogErrorType       = 0x0001
+	eventlogWarningType     = 0x0002
+	eventlogInformationType = 0x0004
+)
+
+var (
+	advapi32                  = syscall.NewLazyDLL("advapi32.dll")
+	procRegisterEventSource   = advapi32.NewProc("RegisterEventSourceW")
+	procDeregisterEventSource = advapi32.NewProc("DeregisterEventSource")
+	procReportEvent           = advapi32.NewProc("ReportEventW")
+)
+
+// EventLogWriter is a LevelWriter that writes lines to the Windows Event
+// Log. Error and fatal lines are reported as errors, warnings as
+// warnings and everything else as information.
+type EventLogWriter struct {
+	mu     sync.Mutex
+	h      syscall.Handle
+	closed bool
+}
+
+// NewEventLogWriter returns an EventLogWriter reporting events from
+// source. The source should be registered (eg: with New-EventLog) for
+// Event Viewer to show the lines without a missing description warning.
+func NewEventLogWriter(source string) (*EventLogWriter, error) {
+	src, err := syscall.UTF16PtrFromString(source)
+	if err != nil {
+		return nil, err
+	}
+
+	h, _, err := procRegisterEventSource.Call(0, uintptr(unsafe.Pointer(src)))
+	if h == 0 {
+		return nil, err
+	}
+
+	return &EventLogWriter{h: syscall.Handle(h)}, nil
+}
+
+// Write reports p as an information event.
+func (w *EventLogWriter) Write(p []byte) (int, error) {
+	return w.WriteLevel(InfoLevel, p)
+}
+
+// WriteLevel reports p as an event of the type for lvl.
+func (w *EventLogWriter) WriteLevel(lvl Level, p []byte) (int, error) {
+	msg, err := syscall.UTF16PtrFromString(string(bytes.TrimRight(p, "\r\n")))
+	if err != nil {
+		return 0, err
+	}
+
+	typ := eventlogInformationType
+	switch {
+	case lvl >= ErrorLevel:
+		typ = eventlogErrorType
+	case lvl == WarnLevel:
+		typ = eventlogWarningType
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+
+	// ReportEventW(handle, type, category, event ID, user SID, number of
+	// strings, raw data size, strings, raw data).
+	ok, _, err := procReportEvent.Call(uintptr(w.h), uintptr(typ), 0, 1, 0, 1, 0,
+		uintptr(unsafe.Pointer(&msg)), 0)
+	if ok == 0 {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// Close deregisters the event source.
+func (w *EventLogWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	if ok, _, err := procDeregisterEventSource.Call(uintptr(w.h)); ok == 0 {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,27 @@
+//go:build windows
+// +build windows
+
+package logf
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestEventLogWriter(t *testing.T) {
+	w, err := NewEventLogWriter("logf-test")
+	require.NoError(t, err)
+
+	var lw LevelWriter = w
+	l := New(Opts{Writer: lw})
+	l.Info("info from logf")
+	l.Warn("warning from logf")
+	l.Error("error from logf", "key", "val")
+
+	require.NoError(t, w.Close())
+	require.NoError(t, w.Close())
+
+	_, err = w.Write([]byte("line\n"))
+	require.ErrorIs(t, err, ErrWriterClosed)
+}
@@ -0,0 +1,145 @@
+package logf
+
+import (
+	"fmt"
+	"reflect"
+	"sync"
+)
+
+// Nested structs deeper than this aren't flattened any further, which
+// also guards against pointer cycles.
+const maxFlattenDepth = 8
+
+// Cache of structLayout by reflect.Type.
+var layoutCache sync.Map
+
+// structLayout is the list of fields of a struct type to be logged.
+type structLayout []layoutField
+
+// layoutField is a field to be logged. index is the path to the field,
+// through embedded structs for promoted fields.
+type layoutField struct {
+	index []int
+	name  string
+}
+
+// structValue returns the struct behind val, dereferencing pointers, if
+// it's to be flattened. Values with their own string representation
+// (errors and fmt.Stringers) and nil pointers aren't flattened.
+func structValue(val interface{}) (reflect.Value, bool) {
+	switch val.(type) {
+	case nil, error, fmt.Stringer:
+		return reflect.Value{}, false
+	}
+
+	v, ok := deref(reflect.ValueOf(val))
+	return v, ok && v.Kind() == reflect.Struct
+}
+
+// deref dereferences pointers, returning false on a nil pointer.
+func deref(v reflect.Value) (reflect.Value, bool) {
+	for v.Kind() == reflect.Ptr {
+		if v.IsNil() {
+			return reflect.Value{}, false
+		}
+		v = v.Elem()
+	}
+
+	return v, true
+}
+
+// flattenStruct appends the fields of the struct v to pairs as key-value
+// pairs, with keys of the form prefix.name. Nested structs are flattened
+// recursively. See getLayout for the fields included.
+func flattenStruct(pairs []interface{}, prefix string, v reflect.Value, depth int) []interface{} {
+	for _, f := range getLayout(v.Type()) {
+		fv, ok := fieldByIndex(v, f.index)
+		if !ok {
+			continue
+		}
+
+		val := fv.Interface()
+		if sv, ok := structValue(val); ok && depth < maxFlattenDepth {
+			pairs = flattenStruct(pairs, prefix+"."+f.name, sv, depth+1)
+			continue
+		}
+
+		pairs = append(pairs, prefix+"."+f.name, val)
+	}
+
+	return pairs
+}
+
+// fieldByIndex is the same as reflect.Value.FieldByIndex, but returns
+// false instead of panicking on a nil embedded pointer.
+func fieldByIndex(v reflect.Value, index []int) (reflect.Value, bool) {
+	for i, x := range index {
+		if i > 0 {
+			var ok bool
+			if v, ok = deref(v); !ok {
+				return reflect.Value{}, false
+			}
+		}
+		v = v.Field(x)
+	}
+
+	return v, true
+}
+
+// getLayout returns the cached layout of the struct type t.
+func getLayout(t reflect.Type) structLayout {
+	if l, ok := layoutCache.Load(t); ok {
+		return l.(structLayout)
+	}
+
+	l, _ := layoutCache.LoadOrStore(t, buildLayout(t, nil, 0))
+	return l.(structLayout)
+}
+
+// buildLayout returns the exported fields of the struct type t. A field
+// is named by its `logf` tag if set, or the field name. Fields tagged
+// `logf:"-"` and unexported fields are skipped. Fields of embedded
+// structs without a tag are promoted to the parent, like encoding/json
+// does, even if the embedded type is unexported.
+func buildLayout(t reflect.Type, index []int, depth int) structLayout {
+	var l structLayout
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if f.PkgPath != "" && !f.Anonymous {
+			continue
+		}
+
+		tag, hasTag := f.Tag.Lookup("logf")
+		if tag == "-" {
+			continue
+		}
+
+		idx := make([]int, len(index)+1)
+		copy(idx, index)
+		idx[len(index)] = i
+
+		if f.Anonymous && !hasTag {
+			ft := f.Type
+			if ft.Kind() == reflect.Ptr {
+				ft = ft.Elem()
+			}
+			if ft.Kind() == reflect.Struct && depth < maxFlattenDepth {
+				l = append(l, buildLayout(ft, idx, depth+1)...)
+			}
+			continue
+		}
+
+		// Embedded fields of unexported types can't be logged as is.
+		if f.PkgPath != "" {
+			continue
+		}
+
+		name := f.Name
+		if tag != "" {
+			name = tag
+		}
+		l = append(l, layoutField{index: idx, name: name})
+	}
+
+	return l
+}
@@ -0,0 +1,147 @@
+package logf
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type address struct {
+	City string `logf:"city"`
+	Zip  string `logf:"-"`
+}
+
+type Meta struct {
+	Source string `logf:"source"`
+}
+
+type base struct {
+	Version int `logf:"version"`
+}
+
+type user struct {
+	ID       int    `logf:"id"`
+	Name     string `logf:"name"`
+	Password string `logf:"-"`
+	Email    string
+	secret   string
+	Address  address `logf:"address"`
+	Created  time.Time
+	Meta
+	base
+}
+
+func TestFlattenStructs(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, FlattenStructs: true})
+
+	u := user{
+		ID:       1,
+		Name:     "karan",
+		Password: "hunter2",
+		Email:    "k@example.com",
+		secret:   "shh",
+		Address:  address{City: "blr", Zip: "560001"},
+		Created:  time.Date(2022, 1, 1, 0, 0, 0, 0, time.UTC),
+		Meta:     Meta{Source: "api"},
+		base:     base{Version: 2},
+	}
+	want := `message=hello user.id=1 user.name=karan user.Email=k@example.com user.address.city=blr user.Created="2022-01-01 00:00:00 +0000 UTC" user.source=api user.version=2 after=1` + "\n"
+
+	l.Info("hello", "user", u, "after", 1)
+	require.Contains(t, buf.String(), want)
+	require.NotContains(t, buf.String(), "hunter2")
+	require.NotContains(t, buf.String(), "shh")
+	require.NotContains(t, buf.String(), "560001")
+	buf.Reset()
+
+	// Pointers are dereferenced.
+	l.Info("hello", "user", &u, "after", 1)
+	require.Contains(t, buf.String(), want)
+	buf.Reset()
+
+	// Nil pointers and structs without fields are written as is.
+	var nilUser *user
+	l.Info("hello", "user", nilUser, "empty", struct{}{})
+	require.Contains(t, buf.String(), `message=hello user=<nil> empty={}`+"\n")
+	buf.Reset()
+
+	// JSON keys are flattened too.
+	l = New(Opts{Writer: buf, FlattenStructs: true, Format: FormatJSON})
+	l.Info("hello", "addr", address{City: "blr"})
+	require.Contains(t, buf.String(), `"message":"hello","addr.city":"blr"}`)
+	buf.Reset()
+
+	// Disabled by default.
+	l = New(Opts{Writer: buf})
+	l.Info("hello", "addr", address{City: "blr", Zip: "1"})
+	require.Contains(t, buf.String(), `message=hello addr="{blr 1}"`)
+}
+
+type node struct {
+	Name string
+	Next *node
+}
+
+func TestFlattenStructsCycle(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, FlattenStructs: true})
+
+	n := &node{Name: "a"}
+	n.Next = n
+	l.Info("hello", "node", n)
+	require.Contains(t, buf.String(), `node.Name=a node.Next.Name=a`)
+}
+
+func TestWithObject(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+
+	u := &user{ID: 1, Name: "karan", Password: "hunter2", Address: address{City: "blr"}, Meta: Meta{Source: "api"}}
+	ul := l.WithObject("user", u)
+	ul.Info("hello", "key", "val")
+	require.Contains(t, buf.String(), `message=hello user.id=1 user.name=karan user.Email= user.address.city=blr user.Created="0001-01-01 00:00:00 +0000 UTC" user.source=api user.version=0 key=val`+"\n")
+	require.NotContains(t, buf.String(), "hunter2")
+	buf.Reset()
+
+	// Non-structs are added as is.
+	l.WithObject("count", 1).Info("hello")
+	require.Contains(t, buf.String(), `message=hello count=1`+"\n")
+	buf.Reset()
+
+	// Nil embedded pointers are skipped.
+	type withPtr struct {
+		*Meta
+		Name string
+	}
+	l.WithObject("obj", withPtr{Name: "x"}).Info("hello")
+	require.Contains(t, buf.String(), `message=hello obj.Name=x`+"\n")
+	buf.Reset()
+	l.WithObject("obj", withPtr{Meta: &Meta{Source: "s"}, Name: "x"}).Info("hello")
+	require.Contains(t, buf.String(), `message=hello obj.source=s obj.Name=x`+"\n")
+}
+
+func BenchmarkFlattenStruct_Cached(b *testing.B) {
+	v := reflect.ValueOf(user{ID: 1, Name: "karan", Address: address{City: "blr"}})
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		flattenStruct(nil, "user", v, 0)
+	}
+}
+
+func BenchmarkFlattenStruct_Uncached(b *testing.B) {
+	v := reflect.ValueOf(user{ID: 1, Name: "karan", Address: address{City: "blr"}})
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		layoutCache.Delete(v.Type())
+		layoutCache.Delete(reflect.TypeOf(address{}))
+		flattenStruct(nil, "user", v, 0)
+	}
+}
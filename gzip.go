@@ -0,0 +1,68 @@
+package logf
+
+import (
+	"compress/gzip"
+	"io"
+	"sync"
+)
+
+// GzipWriter compresses lines written to it with gzip before writing them
+// to the underlying writer.
+//
+// Compressed data is held in memory until enough of it has accumulated,
+// Flush is called or the writer is closed. Flushing after every line
+// would get lines out immediately but ruin the compression ratio, so
+// Flush is left to the caller: call it periodically (or wrap the writer
+// in a BufferedWriter-like scheme), and always call Close on shutdown to
+// finalize the gzip stream. The logger flushes its writer before exiting
+// on Fatal, so the tail isn't lost then.
+type GzipWriter struct {
+	mu     sync.Mutex
+	gz     *gzip.Writer
+	closed bool
+}
+
+// NewGzipWriter returns a GzipWriter writing compressed data to w.
+func NewGzipWriter(w io.Writer) *GzipWriter {
+	return &GzipWriter{gz: gzip.NewWriter(w)}
+}
+
+// Write compresses p. It returns ErrWriterClosed after Close.
+func (g *GzipWriter) Write(p []byte) (int, error) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return 0, ErrWriterClosed
+	}
+
+	return g.gz.Write(p)
+}
+
+// Flush writes any pending compressed data to the underlying writer. The
+// data written so far can then be decompressed, but the gzip stream isn't
+// complete until Close.
+func (g *GzipWriter) Flush() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return nil
+	}
+
+	return g.gz.Flush()
+}
+
+// Close flushes pending data and writes the gzip footer. It doesn't close
+// the underlying writer.
+func (g *GzipWriter) Close() error {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if g.closed {
+		return nil
+	}
+	g.closed = true
+
+	return g.gz.Close()
+}
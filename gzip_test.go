@@ -0,0 +1,54 @@
+package logf
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestGzipWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewGzipWriter(buf)
+	l := New(Opts{Writer: w})
+
+	for i := 0; i < 100; i++ {
+		l.Info("hello world", "component", "db", "count", i)
+	}
+	require.NoError(t, w.Close())
+	require.NoError(t, w.Close())
+
+	_, err := w.Write([]byte("line\n"))
+	require.ErrorIs(t, err, ErrWriterClosed)
+
+	r, err := gzip.NewReader(buf)
+	require.NoError(t, err)
+	out, err := ioutil.ReadAll(r)
+	require.NoError(t, err)
+	require.Equal(t, 100, strings.Count(string(out), "\n"))
+	require.Contains(t, string(out), `message="hello world" component=db count=99`+"\n")
+}
+
+func TestGzipWriterFatalFlush(t *testing.T) {
+	oldExit := exit
+	defer func() { exit = oldExit }()
+	exit = func(int) {}
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: NewGzipWriter(buf)})
+	l.Info("first")
+	l.Fatal("fatal")
+
+	// Without a flush on Fatal, only the gzip header would've been written.
+	r, err := gzip.NewReader(bytes.NewReader(buf.Bytes()))
+	require.NoError(t, err)
+	out := make([]byte, 256)
+	n, err := io.ReadAtLeast(r, out, 1)
+	require.NoError(t, err)
+	require.Equal(t, 2, strings.Count(string(out[:n]), "\n"))
+	require.Contains(t, string(out[:n]), "message=fatal")
+}
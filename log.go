@@ -1,20 +1,46 @@
 package logf
 
 import (
+	"bytes"
+	"context"
+	"database/sql/driver"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	stdlog "log"
+	"math"
 	"os"
+	"reflect"
 	"runtime"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf16"
 	"unicode/utf8"
 )
 
 const (
-	tsKey           = "timestamp="
+	tsKey           = "timestamp"
+	logLevelKey     = "log_level"
+	scopeKey        = "scope"
+	defaultFieldSep = " "
 	defaultTSFormat = "2006-01-02T15:04:05.999Z07:00"
+	consoleTSFormat = "15:04:05.000"
+	deadlineKey     = "deadline_in"
+	seqKey          = "seq"
+	errorKey        = "error"
+	lineKey         = "line"
+	versionKey      = "version"
+	truncatedKey    = "fields_truncated"
+	callerFileKey   = "caller_file"
+	callerLineKey   = "caller_line"
+	callerFuncKey   = "caller_func"
+
+	// Key of the last of odd number of fields, which has no key.
+	badKey = "!BADKEY"
 
 	// ANSI escape codes for coloring text in console.
 	reset  = "\033[0m"
@@ -32,40 +58,305 @@ const (
 	FatalLevel                  // 5
 )
 
+const (
+	// FormatLogfmt emits logs as logfmt key=value pairs.
+	FormatLogfmt Format = iota
+	// FormatConsole emits a human friendly line meant for local
+	// development: a short timestamp, a fixed width level tag and the
+	// message followed by the fields as key=value pairs.
+	FormatConsole
+	// FormatJSON emits logs as newline delimited JSON objects. Numbers and
+	// bools are written as JSON numbers and bools. Color is never applied.
+	FormatJSON
+)
+
 // syncWriter is a wrapper around io.Writer that
 // synchronizes writes using a mutex.
 type syncWriter struct {
 	sync.Mutex
 	w io.Writer
+
+	// Set if w is a LevelWriter.
+	lw LevelWriter
+
+	// Set if w is an AsyncWriter that stamps lines at write time.
+	async *AsyncWriter
+}
+
+// LevelWriter is implemented by writers that need the level of the line
+// being written, eg: to flush immediately on errors. Logger calls
+// WriteLevel instead of Write on writers that implement it.
+type LevelWriter interface {
+	io.Writer
+	WriteLevel(lvl Level, p []byte) (int, error)
 }
 
 // Severity level of the log.
 type Level int
 
+// Format of the emitted log lines.
+type Format int
+
 // Opts represents the config options for the package.
 type Opts struct {
-	Writer               io.Writer
-	Level                Level
-	TimestampFormat      string
-	EnableColor          bool
+	Writer          io.Writer
+	Level           Level
+	Format          Format
+	TimestampFormat string
+
+	// EnableColor is overridden by the environment when New is called:
+	// color is disabled if NO_COLOR is set (https://no-color.org), and
+	// otherwise enabled if FORCE_COLOR is set, or disabled if it's 0.
+	EnableColor bool
+
 	EnableCaller         bool
 	CallerSkipFrameCount int
 
-	// These fields will be printed with every log.
+	// StructuredCaller writes the caller as separate caller_file,
+	// caller_line and caller_func fields instead of a single
+	// caller=file:line field, with caller_line as a number in JSON. It
+	// only applies when EnableCaller is set.
+	StructuredCaller bool
+
+	// CallerMinLevel, if set, limits the caller field to logs at or
+	// above it, eg: WarnLevel, which skips the cost of looking up the
+	// caller of lower level logs. It only applies when EnableCaller is set.
+	CallerMinLevel Level
+
+	// KeyColors colors the keys of fields, eg: {"error": "\033[31m"},
+	// instead of coloring them with the level's color. It only applies
+	// with EnableColor, and colors that aren't ANSI SGR sequences
+	// (\033[<n;..>m) are ignored.
+	KeyColors map[string]string
+
+	// FieldSeparator is written between fields in logfmt and console
+	// formats. It can only contain spaces and tabs, so that it can't be
+	// confused with a value. Defaults to a single space.
+	FieldSeparator string
+
+	// FlattenStructs writes struct field values (and pointers to structs)
+	// as one field per exported struct field, eg: user.id=1 user.name=x,
+	// instead of formatting them with %v. See flattenStruct for how the
+	// keys are named. This uses reflection, so it's slower.
+	FlattenStructs bool
+
+	// KeyTransformer, if set, is applied to the keys of DefaultFields and
+	// the fields passed to every log, eg: to enforce snake_case keys. The
+	// fixed keys (timestamp, level, message, caller) are left as is.
+	KeyTransformer func(key string) string
+
+	// NumericLevel writes the level field as the numeric Level value,
+	// eg: level=4 for errors, instead of its string. LevelStrings is
+	// ignored when set.
+	NumericLevel bool
+
+	// LevelStrings overrides the value written for the level field, eg:
+	// {InfoLevel: "INFO"}. Levels not in the map use Level.String().
+	LevelStrings map[Level]string
+
+	// Filter, if set, is called for every log that passes the level check,
+	// with the fields passed at the call site (not DefaultFields). The log
+	// is dropped if it returns false. As it runs on every log, it should
+	// be cheap.
+	Filter func(lvl Level, msg string, fields []interface{}) bool
+
+	// Sampling, if set, drops repeated lines with the same level and
+	// message in an interval. The first line emitted in an interval
+	// after lines were dropped carries a sampled.dropped=<n> field.
+	Sampling SamplingOpts
+
+	// LevelSampling, if set, emits 1 in N lines for a level, eg:
+	// {DebugLevel: 100} keeps every 100th debug line and all the others.
+	// N <= 1 emits all lines. Fatal lines are never sampled.
+	LevelSampling map[Level]int
+
+	// DedupConsecutive collapses consecutive lines that are the same
+	// apart from their timestamp, like syslog's "last message repeated n
+	// times". The first line is written and the repeats are dropped. The
+	// last repeat is written with a repeated=<n> field when a different
+	// line is logged, or DedupInterval (default 10s) after the first
+	// repeat. Call Logger.Flush before exiting to write pending repeats.
+	// Lines with Sequence or RelativeTimestamps are never the same. It
+	// doesn't apply to Encoders.
+	DedupConsecutive bool
+	DedupInterval    time.Duration
+
+	// AlertHook, if set, is called after a log at or above AlertLevel is
+	// written, with the fields passed at the call site (not
+	// DefaultFields), eg: to page someone on errors. It runs on a new
+	// goroutine so that it doesn't block logging, and a panic in it is
+	// recovered. It may not get to run for a Fatal log, which exits the
+	// program right after. AlertLevel defaults to ErrorLevel.
+	AlertHook  func(lvl Level, msg string, fields []interface{})
+	AlertLevel Level
+
+	// ErrorWriter, if set, gets a structured log line when writing a log
+	// fails, in the logger's format, instead of the plain text written to
+	// the standard library logger. It has the error, the level of the log
+	// and the start of the line that couldn't be written, eg:
+	// level=error message="error logging" error="broken pipe"
+	// log_level=info line="timestamp=... level=info message=hello"
+	ErrorWriter io.Writer
+
+	// These fields will be printed with every log. They're serialized
+	// once when the logger is created (or derived with With), so changing
+	// this on an existing Logger has no effect. Use With instead.
 	DefaultFields []interface{}
+
+	// ProcessFields adds host=<hostname> and pid=<pid> to DefaultFields.
+	// They're looked up once per process, not per log.
+	ProcessFields bool
+
+	// KnownKeys are keys that are escaped once when the logger is
+	// created, eg: request_id or status, so that logs with them skip
+	// escaping them on every call. Keys changed by a KeyTransformer need
+	// to be given as they're written.
+	KnownKeys []string
+
+	// MaxFields, if set, limits the number of fields passed to a log call
+	// that are written, eg: to guard against a loop adding thousands of
+	// fields. The rest are dropped and their count is written as
+	// fields_truncated. It doesn't count DefaultFields.
+	MaxFields int
+
+	// Version, if set, adds version=<Version> to DefaultFields, eg: the
+	// build's commit, to correlate logs with releases.
+	Version string
+
+	// ValueRedactor, if set, is invoked with the key and value of every
+	// string value (including the message) before it's written, and the
+	// returned string is written in its place. It only sees values after
+	// they've been coerced to strings (string, []byte, error, fmt.Stringer
+	// and %v formatted values). Numeric and bool values are not passed in.
+	ValueRedactor func(key, value string) string
+
+	// ASCIIOnly escapes non-ASCII characters as \uXXXX sequences, for
+	// aggregators that can't handle UTF-8. In logfmt, strings with
+	// non-ASCII characters are quoted so that they can be escaped.
+	ASCIIOnly bool
+
+	// FatalExitCode is the exit code of the program after a Fatal log.
+	// Defaults to 1.
+	FatalExitCode int
+
+	// QuoteChar is the character values are quoted with in logfmt and
+	// console formats, eg: '\'' for parsers that expect single quoted
+	// values. It's escaped within values. It can't be a backslash, space,
+	// '=' or a non-printable character. Defaults to '"'. JSON always uses
+	// '"'.
+	QuoteChar byte
+
+	// NullNonFinite writes NaN and ±Inf float values as null in JSON,
+	// instead of the quoted strings "NaN", "+Inf" and "-Inf", as neither
+	// is valid JSON as a number. They're always quoted in logfmt.
+	NullNonFinite bool
+
+	// Sequence adds a seq=<n> field to every line, after the caller, with
+	// a number incremented on every line. Copies of the logger share the
+	// counter, so lines can be totally ordered even if their timestamps
+	// are the same.
+	Sequence bool
+
+	// Clock, if set, returns the time used for timestamps instead of
+	// time.Now, eg: for deterministic output in tests.
+	Clock func() time.Time
+
+	// RelativeTimestamps writes timestamps as the milliseconds passed
+	// since the logger was created, eg: timestamp=12.500ms, instead of
+	// the wall clock time. Loggers derived with With share the start
+	// time. It doesn't apply to Encoders.
+	RelativeTimestamps bool
+
+	// TimestampFromFields uses a "timestamp" field passed to a log call
+	// as the line's timestamp instead of the current time, eg: when
+	// replaying imported events. time.Time values are written with
+	// TimestampFormat. It doesn't apply to the console format or Encoders.
+	TimestampFromFields bool
+
+	// BareTimestamp writes the timestamp without its key at the start of
+	// logfmt lines, eg: 2022-07-07T12:00:00Z level=info, for parsers that
+	// expect it as the first token. It doesn't apply to JSON or Encoders,
+	// and the console format always writes it bare.
+	BareTimestamp bool
+
+	// LineEnding terminates every line. It can be "\n" or "\r\n", eg: for
+	// Windows tools that expect CRLF. Defaults to "\n". It doesn't apply to
+	// Encoders.
+	LineEnding string
+
+	// Encoder, if set, encodes lines instead of the built-in Format. See
+	// Encoder.
+	Encoder Encoder
+
+	// ExitFunc, if set, is called with FatalExitCode after a Fatal log
+	// instead of os.Exit, eg: to test Fatal without exiting. The writer is
+	// flushed before it's called.
+	ExitFunc func(code int)
+
+	// FatalAsError logs Fatal lines at ErrorLevel and returns instead of
+	// exiting, eg: to exercise fatal branches in tests. Code after a Fatal
+	// call then runs, which it was likely not written to handle, so this
+	// shouldn't be set in production.
+	FatalAsError bool
 }
 
 // Logger is the interface for all log operations related to emitting logs.
 type Logger struct {
 	// Output destination.
-	out io.Writer
+	out *syncWriter
 	Opts
+
+	// DefaultFields pre-encoded with the logger's encoder. With color
+	// enabled the keys are colored by level, so there's one buffer per level.
+	fieldsBuf [FatalLevel + 1][]byte
+
+	// keyBits of the DefaultFields keys, to skip looking for them in the
+	// fields of every log.
+	defaultBits uint64
+
+	// The level field pre-encoded with its leading separator, indexed by
+	// level, so that it isn't escaped on every log.
+	lvlFields [FatalLevel + 1][]byte
+
+	// Shared by copies of the logger.
+	sampler *sampler
+
+	lvlSampler *levelSampler
+
+	// Logger for write errors, from Opts.ErrorWriter.
+	errLog *Logger
+
+	dedup *deduper
+
+	// Options for escaping strings.
+	esc escapeOpts
+
+	// Time the logger was created, for RelativeTimestamps.
+	start time.Time
+
+	// Last sequence number written with Sequence. Shared by copies of the
+	// logger.
+	seq *uint64
+
+	// Caller set with WithCaller, written instead of looking it up.
+	caller string
+
+	// Encoders of the built-in format, indexed by level. Unset with
+	// Opts.Encoder.
+	encs *[FatalLevel + 1]Encoder
+
+	// Minimum level to emit, which can be changed with SetLevelAtomic.
+	// Shared by copies of the logger, except those made by WithLevel.
+	lvl *int32
+
+	// Set to 1 by SetQuiet to silence the logger. Shared by all copies.
+	quiet *int32
 }
 
 var (
 	hex     = "0123456789abcdef"
 	bufPool byteBufferPool
-	exit    = func() { os.Exit(1) }
+	exit    = os.Exit
 
 	// Map colors with log level.
 	colorLvlMap = [...]string{
@@ -75,8 +366,35 @@ var (
 		ErrorLevel: red,
 		FatalLevel: red,
 	}
+
+	// Map fixed width level tags for the console format.
+	consoleLvlMap = [...]string{
+		DebugLevel: "DEBUG",
+		InfoLevel:  "INFO ",
+		WarnLevel:  "WARN ",
+		ErrorLevel: "ERROR",
+		FatalLevel: "FATAL",
+	}
 )
 
+// levelColor returns the color of lvl, or no color for an unknown level
+// instead of indexing colorLvlMap out of range.
+func levelColor(lvl Level) string {
+	if lvl < 0 || int(lvl) >= len(colorLvlMap) {
+		return ""
+	}
+	return colorLvlMap[lvl]
+}
+
+// consoleLevelTag returns the console format tag of lvl, or a placeholder
+// of the same width for an unknown level.
+func consoleLevelTag(lvl Level) string {
+	if lvl < DebugLevel || int(lvl) >= len(consoleLvlMap) {
+		return "?????"
+	}
+	return consoleLvlMap[lvl]
+}
+
 // New instantiates a logger object.
 func New(opts Opts) Logger {
 	// Initialize fallbacks if unspecified by user.
@@ -85,41 +403,570 @@ func New(opts Opts) Logger {
 	}
 	if opts.TimestampFormat == "" {
 		opts.TimestampFormat = defaultTSFormat
+		if opts.Format == FormatConsole {
+			opts.TimestampFormat = consoleTSFormat
+		}
 	}
 	if opts.Level == 0 {
 		opts.Level = InfoLevel
 	}
+	opts.EnableColor = colorFromEnv(opts.EnableColor)
+	if !validFieldSeparator(opts.FieldSeparator) {
+		opts.FieldSeparator = defaultFieldSep
+	}
+	if !validQuoteChar(opts.QuoteChar) || opts.Format == FormatJSON {
+		opts.QuoteChar = '"'
+	}
+	if opts.LineEnding != "\r\n" {
+		opts.LineEnding = "\n"
+	}
+	if len(opts.KeyColors) > 0 {
+		colors := make(map[string]string, len(opts.KeyColors))
+		for k, c := range opts.KeyColors {
+			if validColor(c) {
+				colors[k] = c
+			}
+		}
+		opts.KeyColors = colors
+	}
+	if opts.AlertLevel == 0 {
+		opts.AlertLevel = ErrorLevel
+	}
+	if opts.FatalExitCode == 0 {
+		opts.FatalExitCode = 1
+	}
 	if opts.CallerSkipFrameCount == 0 {
 		opts.CallerSkipFrameCount = 3
 	}
 	if len(opts.DefaultFields)%2 != 0 {
-		opts.DefaultFields = opts.DefaultFields[0 : len(opts.DefaultFields)-1]
+		opts.DefaultFields = appendFields(nil, opts.DefaultFields)
+	}
+	if opts.Version != "" {
+		fields := make([]interface{}, 0, len(opts.DefaultFields)+2)
+		opts.DefaultFields = append(append(fields, versionKey, opts.Version), opts.DefaultFields...)
+	}
+	opts.DefaultFields = dedupeFields(opts.DefaultFields)
+	if opts.ProcessFields {
+		pf := getProcessFields()
+		fields := make([]interface{}, 0, len(pf)+len(opts.DefaultFields))
+		opts.DefaultFields = append(append(fields, pf...), opts.DefaultFields...)
+	}
+
+	lvl := int32(opts.Level)
+	l := Logger{
+		out:   newSyncWriter(opts.Writer),
+		Opts:  opts,
+		lvl:   &lvl,
+		quiet: new(int32),
+		esc:   escapeOpts{ascii: opts.ASCIIOnly, quote: opts.QuoteChar, nullNonFinite: opts.NullNonFinite},
+	}
+	l.start = l.now()
+	if opts.Sequence {
+		l.seq = new(uint64)
+	}
+	if opts.Encoder == nil {
+		l.encs = l.builtinEncoders()
+	}
+	l.serializeLevelFields()
+	if opts.Sampling.Interval > 0 {
+		l.sampler = newSampler(opts.Sampling)
+	}
+	l.lvlSampler = newLevelSampler(opts.LevelSampling)
+	l.serializeDefaultFields()
+	if opts.ErrorWriter != nil {
+		format := opts.Format
+		if opts.Encoder != nil {
+			format = FormatLogfmt
+		}
+		errLog := New(Opts{Writer: opts.ErrorWriter, Format: format, TimestampFormat: opts.TimestampFormat, Clock: opts.Clock})
+		l.errLog = &errLog
+	}
+	if opts.DedupConsecutive && opts.Encoder == nil {
+		l.dedup = newDeduper(&l)
+	}
+
+	return l
+}
+
+// ErrNilWriter is returned by NewStrict when the writer is nil.
+var ErrNilWriter = errors.New("logf: nil writer")
+
+// NewStrict instantiates a logger writing to out with the default options,
+// like New. Unlike New, which falls back to stderr, it returns
+// ErrNilWriter if out is nil or a nil pointer, eg: an unopened *os.File.
+func NewStrict(out io.Writer) (Logger, error) {
+	if out == nil {
+		return Logger{}, ErrNilWriter
+	}
+	if v := reflect.ValueOf(out); v.Kind() == reflect.Ptr && v.IsNil() {
+		return Logger{}, ErrNilWriter
+	}
+
+	return New(Opts{Writer: out}), nil
+}
+
+// NewWithScope instantiates a logger writing to out with the default
+// options and a scope field on every log. An empty scope is omitted.
+func NewWithScope(out io.Writer, scope string) Logger {
+	opts := Opts{Writer: out}
+	if scope != "" {
+		opts.DefaultFields = []interface{}{scopeKey, scope}
+	}
+
+	return New(opts)
+}
+
+// With returns a copy of the logger with the given fields appended to its
+// default fields. These are written on every log line, in the order they
+// were added, before the fields passed at the call site.
+func (l Logger) With(fields ...interface{}) Logger {
+	// Copy the fields so that loggers derived from the same parent
+	// don't share the underlying array.
+	f := make([]interface{}, 0, len(l.DefaultFields)+len(fields)+1)
+	f = append(f, l.DefaultFields...)
+	l.DefaultFields = dedupeFields(appendFields(f, fields))
+	l.serializeDefaultFields()
+
+	return l
+}
+
+// WithObject returns a copy of the logger with the exported fields of the
+// struct v (or pointer to a struct) appended to its default fields, with
+// keys of the form prefix.name. Fields are named and skipped based on
+// their `logf` tags, like with FlattenStructs. If v isn't a struct, it's
+// added as is under prefix.
+func (l Logger) WithObject(prefix string, v interface{}) Logger {
+	sv, ok := structValue(v)
+	if !ok {
+		return l.With(prefix, v)
 	}
 
-	return Logger{
-		out:  newSyncWriter(opts.Writer),
-		Opts: opts,
+	return l.With(flattenStruct(nil, prefix, sv, 0)...)
+}
+
+// KV is a key-value pair of OrderedFields.
+type KV struct {
+	Key   string
+	Value interface{}
+}
+
+// OrderedFields is a list of fields that are written in the order given.
+type OrderedFields []KV
+
+// WithOrderedFields returns a copy of the logger with fields appended to
+// its default fields, in the order given. It's the same as With, with
+// typed key-value pairs.
+func (l Logger) WithOrderedFields(fields OrderedFields) Logger {
+	f := make([]interface{}, 0, len(fields)*2)
+	for _, kv := range fields {
+		f = append(f, kv.Key, kv.Value)
 	}
+
+	return l.With(f...)
+}
+
+// F returns a single field, eg: l.WithFieldSets(logf.F("id", 1), common).
+func F(key string, value interface{}) OrderedFields {
+	return OrderedFields{{Key: key, Value: value}}
+}
+
+// WithFieldSets returns a copy of the logger with the fields of all the
+// sets appended to its default fields, in the order given. If a key is in
+// more than one set, the last one wins, as with With.
+func (l Logger) WithFieldSets(sets ...OrderedFields) Logger {
+	n := 0
+	for _, s := range sets {
+		n += len(s)
+	}
+
+	f := make([]interface{}, 0, n*2)
+	for _, s := range sets {
+		for _, kv := range s {
+			f = append(f, kv.Key, kv.Value)
+		}
+	}
+
+	return l.With(f...)
+}
+
+// WithDeadline returns a copy of the logger with a deadline_in field set
+// to the time left until the deadline of ctx, eg: deadline_in=1.5s. The
+// time left is computed when WithDeadline is called, so it's meant for
+// loggers derived right before logging. The logger is returned as is if
+// ctx has no deadline.
+func (l Logger) WithDeadline(ctx context.Context) Logger {
+	d, ok := ctx.Deadline()
+	if !ok {
+		return l
+	}
+
+	return l.With(deadlineKey, time.Until(d))
+}
+
+// WithCaller returns a copy of the logger that writes caller as the caller
+// field of its logs, as is, instead of looking up the caller, eg: for
+// middleware that logs on behalf of the code it wraps. It's written with
+// or without EnableCaller, and as a single field with StructuredCaller.
+func (l Logger) WithCaller(caller string) Logger {
+	l.caller = caller
+	return l
+}
+
+// WithLevel returns a copy of the logger that emits logs at or above lvl.
+// The original logger is unaffected, so a temporary override is undone
+// by discarding the copy.
+func (l Logger) WithLevel(lvl Level) Logger {
+	l.Opts.Level = lvl
+	v := int32(lvl)
+	l.lvl = &v
+	return l
+}
+
+// SetLevelAtomic changes the minimum level of the logger in place. It's
+// safe to call while the logger is in use from other goroutines, and
+// applies to all copies of the logger sharing its level (those made with
+// With, but not WithLevel). Opts.Level holds the initial level and
+// isn't updated.
+func (l Logger) SetLevelAtomic(lvl Level) {
+	if l.lvl != nil {
+		atomic.StoreInt32(l.lvl, int32(lvl))
+	}
+}
+
+// colorFromEnv returns whether color is enabled as per the NO_COLOR and
+// FORCE_COLOR environment variables. enabled is returned if neither is set.
+func colorFromEnv(enabled bool) bool {
+	if os.Getenv("NO_COLOR") != "" {
+		return false
+	}
+	if v := os.Getenv("FORCE_COLOR"); v != "" {
+		return v != "0"
+	}
+	return enabled
+}
+
+// ColorEnabled reports whether the logger's output is colored. Color is
+// only written with EnableColor in the logfmt and console formats and
+// never with an Encoder.
+func (l Logger) ColorEnabled() bool {
+	return l.Opts.EnableColor && l.Opts.Format != FormatJSON && l.Opts.Encoder == nil
+}
+
+// ReplaceWriter swaps the writer of the logger and all of its copies for w,
+// eg: when rotating log files, and returns the old writer so that it can
+// be closed. Lines being written finish on the old writer and later lines
+// go to w, so no line is lost or split between the two. Opts.Writer holds
+// the initial writer and isn't updated.
+func (l Logger) ReplaceWriter(w io.Writer) io.Writer {
+	return l.out.replace(w)
+}
+
+// SetQuiet silences the logger and all of its copies, eg: for a --quiet
+// flag, until it's called with false. Nothing is logged and the Filter,
+// sampling and AlertHook are skipped. Unlike raising the level, the
+// levels of the logger and its copies are kept as they are. The program
+// still exits after a Fatal log.
+func (l Logger) SetQuiet(quiet bool) {
+	if l.quiet == nil {
+		return
+	}
+
+	var v int32
+	if quiet {
+		v = 1
+	}
+	atomic.StoreInt32(l.quiet, v)
+}
+
+// isQuiet returns true if the logger has been silenced with SetQuiet.
+func (l Logger) isQuiet() bool {
+	return l.quiet != nil && atomic.LoadInt32(l.quiet) == 1
+}
+
+// minLevel returns the minimum level of logs to emit.
+func (l Logger) minLevel() Level {
+	if l.lvl == nil {
+		return l.Opts.Level
+	}
+	return Level(atomic.LoadInt32(l.lvl))
+}
+
+// encodeDefaultFields encodes DefaultFields, except the ones whose keys
+// are in fields, which override them.
+func (l *Logger) encodeDefaultFields(enc Encoder, b []byte, lvl Level, fields []interface{}) []byte {
+	// Default fields are already encoded along with their separators.
+	df := l.Opts.DefaultFields
+	if !l.overridesDefaults(fields) {
+		return append(b, l.fieldsBuf[lvl]...)
+	}
+
+	for i := 1; i < len(df); i += 2 {
+		if !hasKey(fields, df[i-1]) {
+			b = l.encodeField(enc, b, df[i-1].(string), df[i])
+		}
+	}
+	return b
+}
+
+// appendFields appends the key-value pairs in fields to f. If there are
+// odd number of fields, the last one is appended as the value of badKey.
+func appendFields(f, fields []interface{}) []interface{} {
+	if len(fields)%2 == 0 {
+		return append(f, fields...)
+	}
+
+	f = append(f, fields[:len(fields)-1]...)
+	return append(f, badKey, fields[len(fields)-1])
+}
+
+// hasKey returns true if key is one of the keys in the key-value pairs
+// in fields. A trailing key without a value isn't a key.
+func hasKey(fields []interface{}, key interface{}) bool {
+	for i := 1; i < len(fields); i += 2 {
+		if fields[i-1] == key {
+			return true
+		}
+	}
+	return false
+}
+
+// keyBit returns the bit of key in a 64-bit set of keys. Keys are only
+// compared when their bits are in a set, so that checking for repeated
+// keys isn't quadratic.
+func keyBit(key interface{}) uint64 {
+	k, _ := key.(string)
+	if k == "" {
+		return 1
+	}
+	return 1 << ((uint(len(k))*31 + uint(k[0])*7 + uint(k[len(k)-1])) & 63)
+}
+
+// keyBits returns the set of the keyBits of the keys in fields, and true
+// if a key is repeated.
+func keyBits(fields []interface{}) (bits uint64, repeated bool) {
+	for i := 1; i < len(fields); i += 2 {
+		b := keyBit(fields[i-1])
+		if bits&b != 0 && !repeated {
+			repeated = hasKey(fields[:i-1], fields[i-1])
+		}
+		bits |= b
+	}
+	return bits, repeated
+}
+
+// overridesDefaults returns true if a key in fields is one of the keys
+// in DefaultFields.
+func (l *Logger) overridesDefaults(fields []interface{}) bool {
+	if l.defaultBits == 0 {
+		return false
+	}
+	for i := 1; i < len(fields); i += 2 {
+		if l.defaultBits&keyBit(fields[i-1]) != 0 && hasKey(l.Opts.DefaultFields, fields[i-1]) {
+			return true
+		}
+	}
+	return false
+}
+
+// dedupeFields returns the key-value pairs in fields with only the last
+// pair for every repeated key. fields is returned as is if there are no
+// repeated keys.
+func dedupeFields(fields []interface{}) []interface{} {
+	var out []interface{}
+	for i := 1; i < len(fields); i += 2 {
+		if !hasKey(fields[i+1:], fields[i-1]) {
+			if out != nil {
+				out = append(out, fields[i-1], fields[i])
+			}
+			continue
+		}
+
+		if out == nil {
+			out = make([]interface{}, 0, len(fields))
+			out = append(out, fields[:i-1]...)
+		}
+	}
+
+	if out == nil {
+		return fields
+	}
+	return out
+}
+
+// serializeLevelFields serializes the level field for every level.
+func (l *Logger) serializeLevelFields() {
+	for lvl := DebugLevel; lvl <= FatalLevel; lvl++ {
+		enc := l.encoder(lvl)
+		b := enc.AppendKey(nil, "level", false)
+
+		switch s, ok := l.Opts.LevelStrings[lvl]; {
+		case l.Opts.NumericLevel:
+			b = enc.AppendInt(b, int64(lvl))
+		case ok:
+			b = enc.AppendString(b, s)
+		default:
+			b = enc.AppendString(b, lvl.String())
+		}
+
+		l.lvlFields[lvl] = b
+	}
+}
+
+// serializeDefaultFields encodes DefaultFields into fieldsBuf so that
+// handleLog can copy them into the line instead of encoding them every time.
+func (l *Logger) serializeDefaultFields() {
+	l.fieldsBuf = [FatalLevel + 1][]byte{}
+	l.defaultBits, _ = keyBits(l.DefaultFields)
+	if len(l.DefaultFields) == 0 {
+		return
+	}
+
+	for lvl := DebugLevel; lvl <= FatalLevel; lvl++ {
+		// Without color, the output is the same for every level.
+		if !l.EnableColor && lvl > DebugLevel {
+			l.fieldsBuf[lvl] = l.fieldsBuf[DebugLevel]
+			continue
+		}
+
+		var b []byte
+		for i := 1; i < len(l.DefaultFields); i += 2 {
+			b = l.encodeField(l.encoder(lvl), b, l.DefaultFields[i-1].(string), l.DefaultFields[i])
+		}
+		l.fieldsBuf[lvl] = b
+	}
+}
+
+// validQuoteChar returns true if c can be used to quote values.
+func validQuoteChar(c byte) bool {
+	return c > ' ' && c < utf8.RuneSelf && c != '\\' && c != '=' && c != 0x7f
+}
+
+// validFieldSeparator returns true if sep is made of only spaces and tabs.
+func validFieldSeparator(sep string) bool {
+	if sep == "" {
+		return false
+	}
+
+	for _, r := range sep {
+		if r != ' ' && r != '\t' {
+			return false
+		}
+	}
+
+	return true
 }
 
 // newSyncWriter wraps an io.Writer with syncWriter. It can
 // be used as an io.Writer as syncWriter satisfies the io.Writer interface.
 func newSyncWriter(in io.Writer) *syncWriter {
+	w := &syncWriter{}
+	w.set(in)
+	return w
+}
+
+// set sets the underlying io.Writer. The caller must hold the lock if
+// the writer is in use.
+func (w *syncWriter) set(in io.Writer) {
 	if in == nil {
-		return &syncWriter{w: os.Stderr}
+		in = os.Stderr
 	}
 
-	return &syncWriter{w: in}
+	w.w = in
+	w.lw, _ = in.(LevelWriter)
+	w.async = nil
+	if aw, ok := in.(*AsyncWriter); ok && aw.opts.TimestampAtWrite {
+		w.async = aw
+	}
+}
+
+// replace swaps the underlying io.Writer once in-flight writes are done
+// and returns the old one.
+func (w *syncWriter) replace(in io.Writer) io.Writer {
+	w.Lock()
+	old := w.w
+	w.set(in)
+	w.Unlock()
+	return old
 }
 
 // Write synchronously to the underlying io.Writer.
 func (w *syncWriter) Write(p []byte) (int, error) {
 	w.Lock()
-	n, err := w.w.Write(p)
+	n, err := writeFull(w.w, p)
 	w.Unlock()
 	return n, err
 }
 
+// writeFull writes all of p to w, retrying the rest after a short write
+// without an error, which some writers do despite the io.Writer contract,
+// so that lines aren't truncated. It gives up with io.ErrShortWrite if a
+// retry makes no progress.
+func writeFull(w io.Writer, p []byte) (int, error) {
+	n, err := w.Write(p)
+	for err == nil && n < len(p) {
+		m, werr := w.Write(p[n:])
+		if werr == nil && m <= 0 {
+			return n, io.ErrShortWrite
+		}
+		n, err = n+m, werr
+	}
+	return n, err
+}
+
+// writeLevelFull is writeFull for a LevelWriter.
+func writeLevelFull(w LevelWriter, lvl Level, p []byte) (int, error) {
+	n, err := w.WriteLevel(lvl, p)
+	for err == nil && n < len(p) {
+		m, werr := w.WriteLevel(lvl, p[n:])
+		if werr == nil && m <= 0 {
+			return n, io.ErrShortWrite
+		}
+		n, err = n+m, werr
+	}
+	return n, err
+}
+
+// flush flushes the underlying io.Writer if it buffers data, so that
+// nothing is lost when the program exits.
+func (w *syncWriter) flush() error {
+	w.Lock()
+	defer w.Unlock()
+
+	f, ok := w.w.(flusher)
+	if !ok {
+		return nil
+	}
+	return f.Flush()
+}
+
+// WriteLevel synchronously writes to the underlying io.Writer, passing on
+// the level if it's a LevelWriter.
+func (w *syncWriter) WriteLevel(lvl Level, p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.lw != nil {
+		return writeLevelFull(w.lw, lvl, p)
+	}
+	return writeFull(w.w, p)
+}
+
+// writeStamped writes a line whose timestamp is at ts in p. If the writer
+// is an AsyncWriter that stamps lines at write time, the timestamp is
+// replaced with the time from clock when it's written.
+func (w *syncWriter) writeStamped(lvl Level, p []byte, ts [2]int, layout string, clock func() time.Time) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.async != nil && ts[1] > 0 {
+		return w.async.writeStamped(lvl, p, ts, layout, clock)
+	}
+	if w.lw != nil {
+		return writeLevelFull(w.lw, lvl, p)
+	}
+	return writeFull(w.w, p)
+}
+
 // String representation of the log severity.
 func (l Level) String() string {
 	switch l {
@@ -138,6 +985,26 @@ func (l Level) String() string {
 	}
 }
 
+// orInfo returns the level, or InfoLevel if it's not one of the defined
+// levels, as the per-level lookups only hold entries for those.
+func (l Level) orInfo() Level {
+	if l < DebugLevel || l > FatalLevel {
+		return InfoLevel
+	}
+	return l
+}
+
+// Enabled returns true if logs at this level are emitted by a logger with
+// the minimum level min.
+func (l Level) Enabled(min Level) bool {
+	return l >= min
+}
+
+// MoreSevereThan returns true if l is a more severe level than other.
+func (l Level) MoreSevereThan(other Level) bool {
+	return l > other
+}
+
 func LevelFromString(lvl string) (Level, error) {
 	switch lvl {
 	case "debug":
@@ -155,11 +1022,6 @@ func LevelFromString(lvl string) (Level, error) {
 	}
 }
 
-// Debug emits a debug log line.
-func (l Logger) Debug(msg string, fields ...interface{}) {
-	l.handleLog(msg, DebugLevel, fields...)
-}
-
 // Info emits a info log line.
 func (l Logger) Info(msg string, fields ...interface{}) {
 	l.handleLog(msg, InfoLevel, fields...)
@@ -175,156 +1037,621 @@ func (l Logger) Error(msg string, fields ...interface{}) {
 	l.handleLog(msg, ErrorLevel, fields...)
 }
 
+// ErrorErr emits an error log line with err as the error field, after the
+// given fields, and returns err as is, eg: return l.ErrorErr("read failed",
+// err). Nothing is logged if err is nil.
+func (l Logger) ErrorErr(msg string, err error, fields ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+
+	f := appendFields(make([]interface{}, 0, len(fields)+3), fields)
+	l.handleLog(msg, ErrorLevel, append(f, errorKey, err)...)
+	return err
+}
+
+// ErrorWrap is ErrorErr, but it returns err wrapped with msg, eg: "read
+// failed: <err>", which can be unwrapped with errors.Is and errors.As.
+func (l Logger) ErrorWrap(msg string, err error, fields ...interface{}) error {
+	if err == nil {
+		return nil
+	}
+
+	f := appendFields(make([]interface{}, 0, len(fields)+3), fields)
+	l.handleLog(msg, ErrorLevel, append(f, errorKey, err)...)
+	return fmt.Errorf("%s: %w", msg, err)
+}
+
+// MultiLine emits every line of text, eg: a stack trace, as a separate log
+// line at lvl with the given fields and the line's number (from 1) as
+// "line". A trailing newline doesn't emit an empty line. Like Fatal, it
+// exits after a FatalLevel text. Invalid levels are logged at InfoLevel.
+func (l Logger) MultiLine(lvl Level, text string, fields ...interface{}) {
+	lvl = lvl.orInfo()
+	if lvl == FatalLevel && l.Opts.FatalAsError {
+		lvl = ErrorLevel
+	}
+	text = strings.TrimSuffix(text, "\n")
+	f := appendFields(make([]interface{}, 0, len(fields)+3), fields)
+	f = append(f, lineKey, 0)
+
+	for n, line := range strings.Split(text, "\n") {
+		f[len(f)-1] = n + 1
+		l.handleLog(strings.TrimSuffix(line, "\r"), lvl, f...)
+	}
+
+	if lvl == FatalLevel {
+		l.exit()
+	}
+}
+
 // Fatal emits a fatal level log line.
-// It aborts the current program with an exit code of 1.
+// It aborts the current program with Opts.FatalExitCode (1 by default).
 func (l Logger) Fatal(msg string, fields ...interface{}) {
+	if l.Opts.FatalAsError {
+		l.handleLog(msg, ErrorLevel, fields...)
+		return
+	}
 	l.handleLog(msg, FatalLevel, fields...)
-	exit()
+	l.exit()
+}
+
+// Log emits a log line at lvl, eg: for a level computed at the call site.
+// Like Fatal, it exits the program after a FatalLevel log. Invalid levels
+// are logged at InfoLevel.
+func (l Logger) Log(lvl Level, msg string, fields ...interface{}) {
+	lvl = lvl.orInfo()
+	if lvl == FatalLevel && l.Opts.FatalAsError {
+		lvl = ErrorLevel
+	}
+	l.handleLog(msg, lvl, fields...)
+	if lvl == FatalLevel {
+		l.exit()
+	}
+}
+
+// exit flushes the writer and exits the program after a Fatal log.
+func (l Logger) exit() {
+	l.flushOut()
+	if l.Opts.ExitFunc != nil {
+		l.Opts.ExitFunc(l.Opts.FatalExitCode)
+		return
+	}
+	exit(l.Opts.FatalExitCode)
+}
+
+// Flush writes the repeats held back by DedupConsecutive, if any, and
+// flushes the writer if it's buffered, eg: an AsyncWriter. Call it before
+// the program exits normally, as Fatal does.
+func (l Logger) Flush() error {
+	if l.dedup != nil {
+		l.dedup.flush()
+	}
+	return l.out.flush()
+}
+
+// flushOut is Flush, reporting an error like a failed write.
+func (l Logger) flushOut() {
+	if err := l.Flush(); err != nil {
+		reportFlushError(l.errLog, err)
+	}
+}
+
+// Infoln emits a info log line with the args formatted like fmt.Sprintln.
+func (l Logger) Infoln(args ...interface{}) {
+	if InfoLevel < l.minLevel() {
+		return
+	}
+	l.handleLog(sprintln(args...), InfoLevel)
+}
+
+// Warnln emits a warning log line with the args formatted like fmt.Sprintln.
+func (l Logger) Warnln(args ...interface{}) {
+	if WarnLevel < l.minLevel() {
+		return
+	}
+	l.handleLog(sprintln(args...), WarnLevel)
+}
+
+// Errorln emits an error log line with the args formatted like fmt.Sprintln.
+func (l Logger) Errorln(args ...interface{}) {
+	if ErrorLevel < l.minLevel() {
+		return
+	}
+	l.handleLog(sprintln(args...), ErrorLevel)
+}
+
+// Fatalln emits a fatal level log line with the args formatted like fmt.Sprintln.
+// It aborts the current program with Opts.FatalExitCode (1 by default).
+func (l Logger) Fatalln(args ...interface{}) {
+	if l.Opts.FatalAsError {
+		l.handleLog(sprintln(args...), ErrorLevel)
+		return
+	}
+	l.handleLog(sprintln(args...), FatalLevel)
+	l.exit()
+}
+
+// sprintln formats args like fmt.Sprintln, without the trailing newline
+// as handleLog adds one.
+func sprintln(args ...interface{}) string {
+	s := fmt.Sprintln(args...)
+	return s[:len(s)-1]
 }
 
 // handleLog emits the log after filtering log level
 // and applying formatting of the fields.
 func (l Logger) handleLog(msg string, lvl Level, fields ...interface{}) {
-	// Discard the log if the verbosity is higher.
-	// For eg, if the lvl is `3` (error), but the incoming message is `0` (debug), skip it.
-	if lvl < l.Opts.Level {
+	ok, dropped := l.filter(lvl, msg, fields)
+	if !ok {
 		return
 	}
 
 	// Get a buffer from the pool.
 	buf := bufPool.Get()
 
-	// Write fixed keys to the buffer before writing user provided ones.
-	writeTimeToBuf(buf, l.Opts.TimestampFormat, lvl, l.Opts.EnableColor)
-	writeToBuf(buf, "level", lvl, lvl, l.Opts.EnableColor, true)
-	writeStringToBuf(buf, "message", msg, lvl, l.Opts.EnableColor, true)
+	// handleLog is one frame deeper than the Debug/Info/... methods.
+	ts := l.writeLineToBuf(buf, msg, lvl, dropped, l.Opts.CallerSkipFrameCount+1, fields)
 
-	if l.Opts.EnableCaller {
-		writeCallerToBuf(buf, "caller", l.Opts.CallerSkipFrameCount, lvl, l.EnableColor, true)
+	var err error
+	if l.dedup != nil {
+		_, err = l.dedup.write(lvl, buf.Bytes(), ts)
+	} else {
+		_, err = l.out.writeStamped(lvl, buf.Bytes(), ts, l.Opts.TimestampFormat, l.Opts.Clock)
+	}
+	if err != nil {
+		// Should ideally never happen.
+		reportWriteError(l.errLog, lvl, buf.Bytes(), err)
 	}
+	l.alert(lvl, msg, fields)
 
-	// Format the line as logfmt.
-	var (
-		count      int // to find out if this is the last key in while itering fields.
-		fieldCount = len(l.DefaultFields) + len(fields)
-		key        string
-	)
+	// Put the writer back in the pool. It resets the underlying byte buffer.
+	bufPool.Put(buf)
+}
+
+// maxFailedLine is how much of a line that couldn't be written is logged
+// to Opts.ErrorWriter.
+const maxFailedLine = 256
+
+// reportFlushError logs err, from flushing the writer, to errLog, or to
+// the standard library logger if there's none.
+func reportFlushError(errLog *Logger, err error) {
+	if errLog == nil {
+		stdlog.Printf("error flushing: %v", err)
+		return
+	}
+	errLog.Error("error flushing", errorKey, err)
+}
+
+// reportWriteError logs err, from writing the line at lvl, to errLog, or
+// to the standard library logger if there's none.
+func reportWriteError(errLog *Logger, lvl Level, line []byte, err error) {
+	if errLog == nil {
+		stdlog.Printf("error logging: %v", err)
+		return
+	}
+
+	line = bytes.TrimRight(line, "\r\n")
+	if len(line) > maxFailedLine {
+		line = line[:maxFailedLine]
+	}
+	// Lines written without a level, eg: with AsyncWriter.Write, have none.
+	if lvl < DebugLevel || lvl > FatalLevel {
+		errLog.Error("error logging", errorKey, err, lineKey, string(line))
+		return
+	}
+	errLog.Error("error logging", errorKey, err, logLevelKey, lvl.String(), lineKey, string(line))
+}
 
-	// If there are odd number of fields, ignore the last.
-	if fieldCount%2 != 0 {
-		fields = fields[0 : len(fields)-1]
+// alert calls Opts.AlertHook on a new goroutine if lvl is at or above
+// Opts.AlertLevel.
+func (l Logger) alert(lvl Level, msg string, fields []interface{}) {
+	if l.Opts.AlertHook == nil || lvl < l.Opts.AlertLevel {
+		return
 	}
 
-	for i := range l.DefaultFields {
-		space := false
-		if count != fieldCount-1 {
-			space = true
+	// The caller may reuse the fields once the log call returns.
+	f := make([]interface{}, len(fields))
+	copy(f, fields)
+
+	go runAlertHook(l.Opts.AlertHook, lvl, msg, f)
+}
+
+// runAlertHook calls hook, recovering from a panic in it. It's separate
+// from alert so that the logger doesn't escape to the heap on every log.
+func runAlertHook(hook func(Level, string, []interface{}), lvl Level, msg string, fields []interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			stdlog.Printf("error in alert hook: %v", r)
 		}
+	}()
+	hook(lvl, msg, fields)
+}
 
-		if i%2 == 0 {
-			key = l.DefaultFields[i].(string)
-			continue
+// Encode returns the serialized log line, including the trailing newline,
+// without writing it. It honors all of the logger's formatting options but
+// not the level filter or sampling. The returned slice is owned by the caller.
+// Invalid levels are encoded as InfoLevel.
+func (l Logger) Encode(lvl Level, msg string, fields ...interface{}) []byte {
+	lvl = lvl.orInfo()
+	buf := bufPool.Get()
+	l.writeLineToBuf(buf, msg, lvl, 0, l.Opts.CallerSkipFrameCount, fields)
+
+	b := make([]byte, len(buf.Bytes()))
+	copy(b, buf.Bytes())
+	bufPool.Put(buf)
+
+	return b
+}
+
+// filter returns false if the log is to be discarded. If sampling is
+// enabled, it also returns the number of lines sampled out.
+func (l Logger) filter(lvl Level, msg string, fields []interface{}) (bool, int) {
+	// Discard the log if the verbosity is higher.
+	// For eg, if the lvl is `3` (error), but the incoming message is `0` (debug), skip it.
+	if lvl < l.minLevel() || l.isQuiet() {
+		return false, 0
+	}
+
+	// Filter gets a copy of the fields, as passing them to a func value
+	// would move them to the heap on every log, even without a Filter.
+	if l.Opts.Filter != nil {
+		f := make([]interface{}, len(fields))
+		copy(f, fields)
+		if !l.Opts.Filter(lvl, msg, f) {
+			return false, 0
 		}
+	}
 
-		writeToBuf(buf, key, l.DefaultFields[i], lvl, l.Opts.EnableColor, space)
-		count++
+	// Fatal lines are never sampled as the program exits after them.
+	if l.lvlSampler != nil && lvl != FatalLevel && !l.lvlSampler.sample(lvl) {
+		return false, 0
 	}
+	if l.sampler != nil && lvl != FatalLevel {
+		return l.sampler.sample(lvl, msg)
+	}
+
+	return true, 0
+}
 
-	for i := range fields {
-		space := false
-		if count != fieldCount-1 {
-			space = true
+// writeLineToBuf encodes a log line to the buffer with the logger's
+// encoder and returns the position of the timestamp in it, if it's known.
+// depth is the number of frames to skip to get to the caller.
+func (l *Logger) writeLineToBuf(buf *byteBuffer, msg string, lvl Level, dropped, depth int, fields []interface{}) (ts [2]int) {
+	enc := l.encoder(lvl)
+
+	// Encode fixed keys before user provided ones. Every field after the
+	// timestamp is encoded as one of many, so the encoder separates it
+	// from the previous one.
+	var b []byte
+	if l.Opts.Encoder == nil && l.Opts.Format == FormatConsole {
+		// The console format starts with the timestamp, level and message
+		// without keys, followed by logfmt fields.
+		ts = l.writeConsolePrefixToBuf(buf, msg, lvl)
+		b = buf.B
+	} else {
+		b, ts = l.encodeTimestamp(enc, enc.BeginLine(buf.B), fields)
+		b = append(b, l.lvlFields[lvl]...)
+
+		// Field-only logs don't get an empty message key.
+		if msg != "" {
+			if l.ValueRedactor != nil {
+				msg = l.ValueRedactor("message", msg)
+			}
+			b = enc.AppendKey(b, "message", false)
+			b = enc.AppendString(b, msg)
 		}
+	}
 
-		if i%2 == 0 {
-			key = fields[i].(string)
-			continue
+	b = l.encodeCaller(enc, b, depth, lvl)
+	b = l.encodeSeq(enc, b)
+
+	fields, truncated := l.truncateFields(fields)
+	_, repeated := keyBits(fields)
+	b = l.encodeDefaultFields(enc, b, lvl, fields)
+
+	// Encode the user provided fields. If there are odd number of fields,
+	// the last one is encoded with badKey. If a key is repeated, only the
+	// last one is encoded.
+	for i := 1; i < len(fields); i += 2 {
+		if !l.skipField(fields, i, repeated) {
+			b = l.encodeField(enc, b, fields[i-1].(string), fields[i])
 		}
+	}
+	if len(fields)%2 != 0 {
+		b = l.encodeField(enc, b, badKey, fields[len(fields)-1])
+	}
+	if truncated > 0 {
+		b = enc.AppendKey(b, truncatedKey, false)
+		b = enc.AppendInt(b, int64(truncated))
+	}
 
-		writeToBuf(buf, key, fields[i], lvl, l.Opts.EnableColor, space)
-		count++
+	if dropped > 0 {
+		b = enc.AppendKey(b, sampledKey, false)
+		b = enc.AppendInt(b, int64(dropped))
 	}
 
-	buf.AppendString("\n")
+	buf.B = enc.EndLine(b)
+	return ts
+}
 
-	_, err := l.out.Write(buf.Bytes())
-	if err != nil {
-		// Should ideally never happen.
-		stdlog.Printf("error logging: %v", err)
+// skipField returns true if the call field with its value at fields[i]
+// isn't written: a repeated key other than the last one, or the timestamp
+// taken by Opts.TimestampFromFields. repeated is from keyBits.
+func (l *Logger) skipField(fields []interface{}, i int, repeated bool) bool {
+	if repeated && hasKey(fields[i+1:], fields[i-1]) {
+		return true
 	}
+	return fields[i-1] == tsKey && l.Opts.TimestampFromFields && (l.Opts.Encoder != nil || l.Opts.Format != FormatConsole)
+}
 
-	// Put the writer back in the pool. It resets the underlying byte buffer.
-	bufPool.Put(buf)
+// truncateFields returns the first Opts.MaxFields fields and the number of
+// fields dropped.
+func (l *Logger) truncateFields(fields []interface{}) ([]interface{}, int) {
+	n := (len(fields) + 1) / 2
+	if l.Opts.MaxFields <= 0 || n <= l.Opts.MaxFields {
+		return fields, 0
+	}
+	return fields[:l.Opts.MaxFields*2], n - l.Opts.MaxFields
 }
 
-// writeTimeToBuf writes timestamp key + timestamp into buffer.
-func writeTimeToBuf(buf *byteBuffer, format string, lvl Level, color bool) {
-	if color {
-		buf.AppendString(getColoredKey(tsKey, lvl))
-	} else {
-		buf.AppendString(tsKey)
+// userTimestamp returns the last "timestamp" field in the call fields if
+// Opts.TimestampFromFields is set.
+func (l *Logger) userTimestamp(fields []interface{}) (interface{}, bool) {
+	if !l.Opts.TimestampFromFields {
+		return nil, false
 	}
+	for i := len(fields) - len(fields)%2 - 2; i >= 0; i -= 2 {
+		if fields[i] == tsKey {
+			return fields[i+1], true
+		}
+	}
+	return nil, false
+}
 
-	buf.AppendTime(time.Now(), format)
-	buf.AppendByte(' ')
+// appendTime writes the timestamp value and returns its position in the
+// buffer. Relative timestamps have no position as they can't be replaced
+// with a TimestampFormat.
+func (l *Logger) appendTime(buf *byteBuffer) (ts [2]int) {
+	if l.Opts.RelativeTimestamps {
+		buf.B = appendMillis(buf.B, l.relativeTime())
+		return ts
+	}
+
+	ts[0] = buf.Len()
+	buf.AppendTime(l.now(), l.Opts.TimestampFormat)
+	ts[1] = buf.Len()
+	return ts
 }
 
-// writeStringToBuf takes key, value and additional options to write to the buffer in logfmt.
-func writeStringToBuf(buf *byteBuffer, key, val string, lvl Level, color, space bool) {
-	if color {
-		escapeAndWriteString(buf, getColoredKey(key, lvl))
-	} else {
-		escapeAndWriteString(buf, key)
+// relativeTime returns the milliseconds passed since the logger was
+// created, for RelativeTimestamps.
+func (l *Logger) relativeTime() float64 {
+	return float64(l.now().Sub(l.start)) / float64(time.Millisecond)
+}
+
+// appendMillis appends ms with three decimals and the unit, eg: 1.500ms.
+func appendMillis(dst []byte, ms float64) []byte {
+	return append(strconv.AppendFloat(dst, ms, 'f', 3, 64), "ms"...)
+}
+
+// now returns the current time from Opts.Clock.
+func (l *Logger) now() time.Time {
+	if l.Opts.Clock != nil {
+		return l.Opts.Clock()
 	}
+	return time.Now()
+}
 
-	buf.AppendByte('=')
-	escapeAndWriteString(buf, val)
+// writeConsolePrefixToBuf writes the timestamp, level tag and message
+// without any keys, for the console format.
+func (l *Logger) writeConsolePrefixToBuf(buf *byteBuffer, msg string, lvl Level) (ts [2]int) {
+	ts = l.appendTime(buf)
+	buf.AppendByte(' ')
+
+	if l.Opts.EnableColor {
+		buf.AppendString(levelColor(lvl))
+		buf.AppendString(consoleLevelTag(lvl))
+		buf.AppendString(reset)
+	} else {
+		buf.AppendString(consoleLevelTag(lvl))
+	}
 
-	if space {
+	if l.ValueRedactor != nil {
+		msg = l.ValueRedactor("message", msg)
+	}
+	if msg != "" {
 		buf.AppendByte(' ')
+		writeConsoleMessage(buf, msg, l.esc)
+	}
+
+	return ts
+}
+
+// writeConsoleMessage writes the unquoted console message with control
+// characters escaped like in the other formats, eg: \n, so that a message
+// can't break the line or forge another one. With esc.ascii set,
+// non-ASCII characters are escaped too.
+func writeConsoleMessage(buf *byteBuffer, msg string, esc escapeOpts) {
+	start := 0
+	for i := 0; i < len(msg); i++ {
+		b := msg[i]
+		if b >= 0x20 {
+			continue
+		}
+
+		writeConsoleText(buf, msg[start:i], esc)
+		switch b {
+		case '\n':
+			buf.AppendString(`\n`)
+		case '\r':
+			buf.AppendString(`\r`)
+		case '\t':
+			buf.AppendString(`\t`)
+		default:
+			buf.AppendString(`\u00`)
+			buf.AppendByte(hex[b>>4])
+			buf.AppendByte(hex[b&0xF])
+		}
+		start = i + 1
+	}
+	writeConsoleText(buf, msg[start:], esc)
+}
+
+// writeConsoleText writes s as is, or with non-ASCII characters escaped
+// with esc.ascii set.
+func writeConsoleText(buf *byteBuffer, s string, esc escapeOpts) {
+	if esc.ascii {
+		writeNonASCIIEscaped(buf, s)
+		return
+	}
+	buf.AppendString(s)
+}
+
+// validColor returns true if c is an ANSI SGR sequence, eg: \033[1;31m,
+// which can't corrupt the output.
+func validColor(c string) bool {
+	if len(c) < 4 || !strings.HasPrefix(c, "\033[") || c[len(c)-1] != 'm' {
+		return false
 	}
+	for i := 2; i < len(c)-1; i++ {
+		if (c[i] < '0' || c[i] > '9') && c[i] != ';' {
+			return false
+		}
+	}
+	return true
 }
 
-func writeCallerToBuf(buf *byteBuffer, key string, depth int, lvl Level, color, space bool) {
-	_, file, line, ok := runtime.Caller(depth)
+// callerFrame returns the file, line and function of the caller at depth,
+// counted like runtime.Caller from the function calling callerFrame.
+func callerFrame(depth int) (string, int, string) {
+	pc, file, line, ok := runtime.Caller(depth + 1)
 	if !ok {
-		file = "???"
-		line = 0
+		return "???", 0, "???"
 	}
 
-	if color {
-		buf.AppendString(getColoredKey(key, lvl))
-	} else {
-		buf.AppendString(key)
+	fn := "???"
+	if f := runtime.FuncForPC(pc); f != nil {
+		fn = f.Name()
 	}
+	return file, line, fn
+}
 
-	buf.AppendByte('=')
-	escapeAndWriteString(buf, file)
-	buf.AppendByte(':')
-	buf.AppendInt(int64(line))
+// joinedErrors returns the errors of a multi-error, like the ones returned
+// by errors.Join.
+func joinedErrors(val interface{}) ([]error, bool) {
+	e, ok := val.(interface{ Unwrap() []error })
+	if !ok {
+		return nil, false
+	}
 
-	if space {
-		buf.AppendByte(' ')
+	errs := e.Unwrap()
+	return errs, len(errs) > 0
+}
+
+// stringValue returns the string form of values that are written as
+// strings by writeValueToBuf. It returns false for numeric, bool and nil values.
+func stringValue(val interface{}) (string, bool) {
+	switch v := val.(type) {
+	case nil, Raw, int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, float32, float64, complex64, complex128, bool:
+		return "", false
+	case []byte:
+		return string(v), true
+	case string:
+		return v, true
+	case error:
+		return errorValue(v), true
+	case fmt.Stringer:
+		return stringerValue(v), true
+	default:
+		return fmt.Sprintf("%v", val), true
 	}
 }
 
-// writeToBuf takes key, value and additional options to write to the buffer in logfmt.
-func writeToBuf(buf *byteBuffer, key string, val interface{}, lvl Level, color, space bool) {
-	if color {
-		escapeAndWriteString(buf, getColoredKey(key, lvl))
-	} else {
-		escapeAndWriteString(buf, key)
+// stringerValue returns v.String(), or panicValue if it panics.
+func stringerValue(v fmt.Stringer) (s string) {
+	defer func() {
+		if r := recover(); r != nil {
+			s = panicValue(v, r)
+		}
+	}()
+
+	return v.String()
+}
+
+// valuerValue returns the value of database types like sql.NullString, eg:
+// the string if it's valid and nil (null) if not, instead of the struct.
+// It's the error if Value fails, or panicValue if it panics.
+func valuerValue(v driver.Valuer) (val interface{}) {
+	defer func() {
+		if r := recover(); r != nil {
+			val = panicValue(v, r)
+		}
+	}()
+
+	val, err := v.Value()
+	if err != nil {
+		return err
 	}
+	return val
+}
 
-	buf.AppendByte('=')
+// errorValue returns v.Error(), or panicValue if it panics.
+func errorValue(v error) (s string) {
+	defer func() {
+		if r := recover(); r != nil {
+			s = panicValue(v, r)
+		}
+	}()
+
+	return v.Error()
+}
 
+// marshalJSON returns v encoded with encoding/json. If v can't be
+// marshalled, ok is false and s is what's written instead: the %v of v,
+// or panicValue if a MarshalJSON method panics.
+func marshalJSON(v interface{}) (b []byte, s string, ok bool) {
+	defer func() {
+		if r := recover(); r != nil {
+			b, s, ok = nil, panicValue(v, r), false
+		}
+	}()
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Sprintf("%v", v), false
+	}
+	return b, "", true
+}
+
+// panicValue is written in place of a value whose method panicked with r,
+// so that logging never crashes the program. Like fmt, it's "<nil>" if v
+// is a nil pointer, eg: a nil *big.Float, and !PANIC(r) otherwise.
+func panicValue(v interface{}, r interface{}) string {
+	if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr && rv.IsNil() {
+		return "<nil>"
+	}
+	return fmt.Sprintf("!PANIC(%v)", r)
+}
+
+// Raw is a field value that's already encoded, eg: a cached JSON fragment.
+// It's written as is, without any quoting or escaping, so it's up to the
+// caller to ensure it's valid in the logger's format. Raw values aren't
+// passed to ValueRedactor.
+type Raw []byte
+
+// writeValueToBuf writes the value to the buffer in logfmt. Strings are
+// escaped as per esc.
+func writeValueToBuf(buf *byteBuffer, val interface{}, esc escapeOpts) {
 	switch v := val.(type) {
 	case nil:
 		buf.AppendString("null")
+	case Raw:
+		buf.AppendBytes(v)
 	case []byte:
-		escapeAndWriteString(buf, string(v))
+		escapeAndWriteString(buf, string(v), esc)
 	case string:
-		escapeAndWriteString(buf, v)
+		escapeAndWriteString(buf, v, esc)
 	case int:
 		buf.AppendInt(int64(v))
 	case int8:
@@ -335,54 +1662,216 @@ func writeToBuf(buf *byteBuffer, key string, val interface{}, lvl Level, color,
 		buf.AppendInt(int64(v))
 	case int64:
 		buf.AppendInt(v)
+	case uint:
+		buf.AppendUint(uint64(v))
+	case uint8:
+		buf.AppendUint(uint64(v))
+	case uint16:
+		buf.AppendUint(uint64(v))
+	case uint32:
+		buf.AppendUint(uint64(v))
+	case uint64:
+		buf.AppendUint(v)
 	case float32:
-		buf.AppendFloat(float64(v), 32)
+		writeFloatToBuf(buf, float64(v), 32, esc)
 	case float64:
-		buf.AppendFloat(v, 64)
+		writeFloatToBuf(buf, v, 64, esc)
+	case complex64:
+		buf.AppendComplex(complex128(v), 32)
+	case complex128:
+		buf.AppendComplex(v, 64)
 	case bool:
 		buf.AppendBool(v)
 	case error:
-		escapeAndWriteString(buf, v.Error())
+		escapeAndWriteString(buf, errorValue(v), esc)
 	case fmt.Stringer:
-		escapeAndWriteString(buf, v.String())
+		escapeAndWriteString(buf, stringerValue(v), esc)
+	case json.Marshaler:
+		// Compact JSON, or what's written instead if it can't be marshalled.
+		b, s, ok := marshalJSON(v)
+		if !ok {
+			escapeAndWriteString(buf, s, esc)
+			return
+		}
+		escapeAndWriteString(buf, string(b), esc)
 	default:
-		escapeAndWriteString(buf, fmt.Sprintf("%v", val))
+		if s, ok := typeValue(val); ok {
+			escapeAndWriteString(buf, s, esc)
+			return
+		}
+		// fmt sorts map keys, so maps are written deterministically.
+		escapeAndWriteString(buf, fmt.Sprintf("%v", val), esc)
 	}
+}
 
-	if space {
-		buf.AppendByte(' ')
+// writeJSONValueToBuf writes the value to the buffer as JSON, preserving
+// numbers and bools. Slices, maps and structs are encoded with encoding/json,
+// which sorts map keys.
+func writeJSONValueToBuf(buf *byteBuffer, val interface{}, esc escapeOpts) {
+	switch v := val.(type) {
+	case nil:
+		buf.AppendString("null")
+	case Raw:
+		buf.AppendBytes(v)
+	case []byte:
+		writeQuotedString(buf, string(v), esc)
+	case string:
+		writeQuotedString(buf, v, esc)
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64, bool:
+		writeValueToBuf(buf, v, esc)
+	case float32:
+		writeJSONFloatToBuf(buf, float64(v), 32, esc)
+	case float64:
+		writeJSONFloatToBuf(buf, v, 64, esc)
+	case complex64, complex128:
+		buf.AppendByte('"')
+		writeValueToBuf(buf, v, esc)
+		buf.AppendByte('"')
+	case error:
+		writeQuotedString(buf, errorValue(v), esc)
+	case json.Marshaler:
+		writeMarshalledToBuf(buf, v, esc)
+	case fmt.Stringer:
+		writeQuotedString(buf, stringerValue(v), esc)
+	default:
+		if s, ok := typeValue(v); ok {
+			writeQuotedString(buf, s, esc)
+			return
+		}
+		writeMarshalledToBuf(buf, v, esc)
 	}
 }
 
+// typeValue returns the type name of channels, funcs and unsafe pointers,
+// eg: chan int, instead of their address, which changes on every run. Nil
+// ones are written like %#v, eg: (func())(nil).
+func typeValue(val interface{}) (string, bool) {
+	v := reflect.ValueOf(val)
+	switch v.Kind() {
+	case reflect.Chan, reflect.Func, reflect.UnsafePointer:
+		if v.IsNil() {
+			return "(" + v.Type().String() + ")(nil)", true
+		}
+		return v.Type().String(), true
+	}
+	return "", false
+}
+
+// writeFloatToBuf writes a float in logfmt. NaN and ±Inf are quoted, as
+// they're not numbers to most parsers.
+func writeFloatToBuf(buf *byteBuffer, f float64, bitSize int, esc escapeOpts) {
+	if math.IsNaN(f) || math.IsInf(f, 0) {
+		writeQuotedString(buf, nonFiniteString(f), esc)
+		return
+	}
+	buf.AppendFloat(f, bitSize)
+}
+
+// writeJSONFloatToBuf writes a float in JSON. NaN and ±Inf are written as
+// strings, or null with esc.nullNonFinite, as they're not valid JSON.
+func writeJSONFloatToBuf(buf *byteBuffer, f float64, bitSize int, esc escapeOpts) {
+	if !math.IsNaN(f) && !math.IsInf(f, 0) {
+		buf.AppendFloat(f, bitSize)
+		return
+	}
+	if esc.nullNonFinite {
+		buf.AppendString("null")
+		return
+	}
+	writeQuotedString(buf, nonFiniteString(f), esc)
+}
+
+// nonFiniteString returns the string for NaN or ±Inf, as strconv
+// formats them.
+func nonFiniteString(f float64) string {
+	switch {
+	case math.IsNaN(f):
+		return "NaN"
+	case f > 0:
+		return "+Inf"
+	}
+	return "-Inf"
+}
+
+// writeMarshalledToBuf writes val encoded with encoding/json, or what's
+// written instead quoted if it can't be marshalled.
+func writeMarshalledToBuf(buf *byteBuffer, val interface{}, esc escapeOpts) {
+	b, s, ok := marshalJSON(val)
+	if !ok {
+		writeQuotedString(buf, s, esc)
+		return
+	}
+
+	// Non-ASCII characters can only be within JSON strings, where they
+	// can be escaped as is.
+	if esc.ascii {
+		writeNonASCIIEscaped(buf, string(b))
+		return
+	}
+	buf.AppendBytes(b)
+}
+
 // escapeAndWriteString escapes the string if interface{} unwanted chars are there.
-func escapeAndWriteString(buf *byteBuffer, s string) {
+// With esc.ascii set, strings with non-ASCII characters are quoted so that
+// they can be escaped.
+func escapeAndWriteString(buf *byteBuffer, s string, esc escapeOpts) {
 	idx := strings.IndexFunc(s, checkEscapingRune)
-	if idx != -1 || s == "null" {
-		writeQuotedString(buf, s)
+	if idx != -1 || s == "null" || (esc.ascii && !isASCII(s)) ||
+		(esc.quote != '"' && strings.IndexByte(s, esc.quote) != -1) {
+		writeQuotedString(buf, s, esc)
 		return
 	}
 
 	buf.AppendString(s)
 }
 
-// getColoredKey returns a color formatter key based on the log level.
-func getColoredKey(k string, lvl Level) string {
-	return colorLvlMap[lvl] + k + reset
+// checkEscapingRune returns true if the rune is to be escaped. Control
+// characters are escaped so that they can't be confused with the
+// separator or the end of the line.
+func checkEscapingRune(r rune) bool {
+	return r == '=' || r == ' ' || r == '"' || r < 0x20 || r == utf8.RuneError
 }
 
-// checkEscapingRune returns true if the rune is to be escaped.
-func checkEscapingRune(r rune) bool {
-	return r == '=' || r == ' ' || r == '"' || r == utf8.RuneError
+// escapeOpts are the options for escaping and quoting values, set from
+// Opts in New.
+type escapeOpts struct {
+	// Escape non-ASCII characters.
+	ascii bool
+
+	// Character to quote strings with.
+	quote byte
+
+	// Write NaN and ±Inf as null in JSON.
+	nullNonFinite bool
 }
 
-// writeQuotedString quotes a string before writing to the buffer.
+// isASCII returns true if s only has ASCII characters.
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
+
+// writeQuotedString quotes a string with the quote character before
+// writing to the buffer.
+func writeQuotedString(buf *byteBuffer, s string, esc escapeOpts) {
+	buf.AppendByte(esc.quote)
+	writeEscapedString(buf, s, esc)
+	buf.AppendByte(esc.quote)
+}
+
+// writeEscapedString writes a string to the buffer, escaping it to be
+// placed within the quote character. With ascii set, non-ASCII characters
+// are written as \uXXXX escapes, with surrogate pairs above U+FFFF.
 // Taken from: https://github.com/go-logfmt/logfmt/blob/99455b83edb21b32a1f1c0a32f5001b77487b721/jsonstring.go#L95
-func writeQuotedString(buf *byteBuffer, s string) {
-	buf.AppendByte('"')
+func writeEscapedString(buf *byteBuffer, s string, esc escapeOpts) {
 	start := 0
 	for i := 0; i < len(s); {
 		if b := s[i]; b < utf8.RuneSelf {
-			if 0x20 <= b && b != '\\' && b != '"' {
+			if 0x20 <= b && b != '\\' && b != esc.quote {
 				i++
 				continue
 			}
@@ -392,7 +1881,7 @@ func writeQuotedString(buf *byteBuffer, s string) {
 			}
 
 			switch b {
-			case '\\', '"':
+			case '\\', esc.quote:
 				buf.AppendByte('\\')
 				buf.AppendByte(b)
 			case '\n':
@@ -428,12 +1917,67 @@ func writeQuotedString(buf *byteBuffer, s string) {
 			start = i
 			continue
 		}
+		if esc.ascii {
+			if start < i {
+				buf.AppendString(s[start:i])
+			}
+
+			writeRuneEscape(buf, c)
+
+			i += size
+			start = i
+			continue
+		}
+		i += size
+	}
+
+	if start < len(s) {
+		buf.AppendString(s[start:])
+	}
+}
+
+// writeNonASCIIEscaped writes s to the buffer with non-ASCII characters
+// written as \uXXXX escapes and everything else as is.
+func writeNonASCIIEscaped(buf *byteBuffer, s string) {
+	start := 0
+	for i := 0; i < len(s); {
+		if s[i] < utf8.RuneSelf {
+			i++
+			continue
+		}
+
+		if start < i {
+			buf.AppendString(s[start:i])
+		}
+
+		c, size := utf8.DecodeRuneInString(s[i:])
+		writeRuneEscape(buf, c)
+
 		i += size
+		start = i
 	}
 
 	if start < len(s) {
 		buf.AppendString(s[start:])
 	}
+}
+
+// writeRuneEscape writes r as a \uXXXX escape, or a pair of them for the
+// UTF-16 surrogates of runes above U+FFFF.
+func writeRuneEscape(buf *byteBuffer, r rune) {
+	if r1, r2 := utf16.EncodeRune(r); r1 != utf8.RuneError {
+		writeUTF16Escape(buf, r1)
+		writeUTF16Escape(buf, r2)
+		return
+	}
+
+	writeUTF16Escape(buf, r)
+}
 
-	buf.AppendByte('"')
+func writeUTF16Escape(buf *byteBuffer, r rune) {
+	buf.AppendString(`\u`)
+	buf.AppendByte(hex[r>>12&0xF])
+	buf.AppendByte(hex[r>>8&0xF])
+	buf.AppendByte(hex[r>>4&0xF])
+	buf.AppendByte(hex[r&0xF])
 }
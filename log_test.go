@@ -2,12 +2,25 @@ package logf
 
 import (
 	"bytes"
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"log"
+	"math"
+	"math/big"
+	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
+	"time"
+	"unicode/utf8"
 
 	"github.com/stretchr/testify/require"
 )
@@ -18,12 +31,12 @@ func TestLogFormatWithEnableCaller(t *testing.T) {
 
 	l.Info("hello world")
 	require.Contains(t, buf.String(), `level=info message="hello world" caller=`)
-	require.Contains(t, buf.String(), `logf/log_test.go:19`)
+	require.Contains(t, buf.String(), `logf/log_test.go:32`)
 	buf.Reset()
 
 	lC := New(Opts{Writer: buf, EnableCaller: true, EnableColor: true})
 	lC.Info("hello world")
-	require.Contains(t, buf.String(), `logf/log_test.go:25`)
+	require.Contains(t, buf.String(), `logf/log_test.go:38`)
 	buf.Reset()
 }
 
@@ -71,6 +84,8 @@ func TestNewLoggerDefault(t *testing.T) {
 	require.Equal(t, l.Opts.EnableCaller, false, "caller is disabled")
 	require.Equal(t, l.Opts.CallerSkipFrameCount, 3, "skip frame count is 3")
 	require.Equal(t, l.Opts.TimestampFormat, defaultTSFormat, "timestamp format is default")
+	require.Equal(t, l.Opts.Format, FormatLogfmt, "format is logfmt")
+	require.Equal(t, l.Opts.FieldSeparator, " ", "field separator is a space")
 }
 
 func TestNewSyncWriterWithNil(t *testing.T) {
@@ -79,6 +94,8 @@ func TestNewSyncWriterWithNil(t *testing.T) {
 }
 
 func TestLogFormat(t *testing.T) {
+	skipWithoutDebug(t)
+
 	buf := &bytes.Buffer{}
 
 	l := New(Opts{Writer: buf, Level: DebugLevel})
@@ -112,8 +129,8 @@ func TestLogFormat(t *testing.T) {
 
 	// Fatal log
 	var hadExit bool
-	exit = func() {
-		hadExit = true
+	exit = func(code int) {
+		hadExit = code == 1
 	}
 
 	l.Fatal("fatal log")
@@ -128,7 +145,7 @@ func TestLogFormatWithColor(t *testing.T) {
 
 	// Info log.
 	l.Info("hello world")
-	require.Contains(t, buf.String(), "\x1b[36mlevel\x1b[0m=info \x1b[36mmessage\x1b[0m=\"hello world\" \n")
+	require.Contains(t, buf.String(), "\x1b[36mlevel\x1b[0m=info \x1b[36mmessage\x1b[0m=\"hello world\"\n")
 	buf.Reset()
 }
 
@@ -151,7 +168,7 @@ func TestLoggerTypes(t *testing.T) {
 		"bool", true,
 	)
 
-	require.Contains(t, buf.String(), "level=info message=\"hello world\" string=foo int=1 int8=1 int16=1 int32=1 int64=1 float32=1 float64=1 struct={1} bool=true \n")
+	require.Contains(t, buf.String(), "level=info message=\"hello world\" string=foo int=1 int8=1 int16=1 int32=1 int64=1 float32=1 float64=1 struct={1} bool=true\n")
 }
 
 func TestLogFormatWithDefaultFields(t *testing.T) {
@@ -203,7 +220,7 @@ func TestWriteQuotedStringCases(t *testing.T) {
 		{key: "k", value: 1, want: "k=1"},
 		{key: "k", value: 1.025, want: "k=1.025"},
 		{key: "k", value: 1e-3, want: "k=0.001"},
-		{key: "k", value: 3.5 + 2i, want: "k=(3.5+2i)"},
+		{key: "k", value: 3.5 + 2i, want: "k=3.5+2i"},
 		{key: "k", value: "v v", want: `k="v v"`},
 		{key: "k", value: " ", want: `k=" "`},
 		{key: "k", value: `"`, want: `k="\""`},
@@ -267,3 +284,1556 @@ func genLogs(l Logger) {
 		l.Info("random log", "index", strconv.FormatInt(int64(i), 10))
 	}
 }
+
+func TestValueRedactor(t *testing.T) {
+	buf := &bytes.Buffer{}
+	re := regexp.MustCompile(`\b\d{4}-\d{4}-\d{4}-\d{4}\b`)
+	l := New(Opts{Writer: buf, ValueRedactor: func(key, value string) string {
+		return re.ReplaceAllString(value, "****")
+	}})
+
+	l.Info("paid with 1234-5678-9012-3456", "card", "1234-5678-9012-3456", "note", []byte("card 1111-2222-3333-4444"), "amount", 100)
+	require.Contains(t, buf.String(), `level=info message="paid with ****" card=**** note="card ****" amount=100`)
+	require.NotContains(t, buf.String(), "1234-5678-9012-3456")
+	buf.Reset()
+
+	// Non-string values should not be passed to the redactor.
+	var keys []string
+	l = New(Opts{Writer: buf, ValueRedactor: func(key, value string) string {
+		keys = append(keys, key)
+		return value
+	}})
+	l.Info("hello", "int", 1, "bool", true, "nil", nil, "err", errors.New("oops"))
+	require.Equal(t, []string{"message", "err"}, keys)
+	require.Contains(t, buf.String(), `int=1 bool=true nil=null err=oops`)
+}
+
+func TestLoggerWith(t *testing.T) {
+	buf := &bytes.Buffer{}
+	base := New(Opts{Writer: buf, DefaultFields: []interface{}{"service", "api"}})
+	l := base.With("version", "v1.0.0", "env", "prod")
+
+	l.Info("hello world", "component", "logf")
+	require.Contains(t, buf.String(), `level=info message="hello world" service=api version=v1.0.0 env=prod component=logf`)
+	buf.Reset()
+
+	// The parent logger should be unaffected.
+	base.Info("hello world")
+	require.Contains(t, buf.String(), `level=info message="hello world" service=api`)
+	require.NotContains(t, buf.String(), "version=")
+	buf.Reset()
+
+	// Siblings derived from the same parent shouldn't share fields.
+	a := l.With("host", "a")
+	b := l.With("host", "b")
+	a.Info("hello world")
+	require.Contains(t, buf.String(), `env=prod host=a`)
+	buf.Reset()
+	b.Info("hello world")
+	require.Contains(t, buf.String(), `env=prod host=b`)
+	buf.Reset()
+
+	// The last of odd number of fields has no key.
+	l = base.With("key1", "val1", "key2")
+	l.Info("hello world")
+	require.Contains(t, buf.String(), `service=api key1=val1 !BADKEY=key2`+"\n")
+}
+
+func TestDefaultFieldsSerialization(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, DefaultFields: []interface{}{"service", "api"}})
+
+	// Serialized fields should be rebuilt when fields change.
+	l = l.With("version", "v1")
+	l.Info("hello world")
+	require.Contains(t, buf.String(), `message="hello world" service=api version=v1`)
+	buf.Reset()
+
+	// Repeated keys override the earlier ones.
+	l = l.With("version", "v2")
+	l.Info("hello world")
+	require.Contains(t, buf.String(), `message="hello world" service=api version=v2`+"\n")
+	buf.Reset()
+
+	// With color, keys are colored by the level of the line.
+	l = New(Opts{Writer: buf, EnableColor: true, DefaultFields: []interface{}{"service", "api"}})
+	l.Info("hello world")
+	require.Contains(t, buf.String(), "\x1b[36mservice\x1b[0m=api")
+	buf.Reset()
+	l.Error("hello world")
+	require.Contains(t, buf.String(), "\x1b[31mservice\x1b[0m=api")
+}
+
+func TestEmptyMessage(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+
+	l.Info("", "component", "logf")
+	require.Contains(t, buf.String(), `level=info component=logf`)
+	require.NotContains(t, buf.String(), "message=")
+	buf.Reset()
+
+	l.Info("")
+	require.Contains(t, buf.String(), `level=info`)
+	require.NotContains(t, buf.String(), "message=")
+}
+
+func TestNoTrailingWhitespace(t *testing.T) {
+	buf := &bytes.Buffer{}
+	cases := []struct {
+		name   string
+		opts   Opts
+		fields []interface{}
+	}{
+		{"no fields", Opts{}, nil},
+		{"fields", Opts{}, []interface{}{"key", "val"}},
+		{"odd fields", Opts{}, []interface{}{"key", "val", "key2"}},
+		{"caller", Opts{EnableCaller: true}, nil},
+		{"default fields", Opts{DefaultFields: []interface{}{"key", "val"}}, nil},
+		{"color", Opts{EnableColor: true}, []interface{}{"key", "val"}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.opts.Writer = buf
+			l := New(c.opts)
+			l.Info("hello world", c.fields...)
+			line := buf.String()
+			require.True(t, strings.HasSuffix(line, "\n"), "line should end with a newline")
+			require.Equal(t, strings.TrimRight(line, " \t\n"), strings.TrimSuffix(line, "\n"), "no trailing whitespace")
+			require.NotContains(t, line, "  ", "no double spaces")
+			buf.Reset()
+		})
+	}
+}
+
+func TestColoredMessage(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, EnableColor: true})
+
+	l.Warn("a=b \"quoted\"\n")
+	require.Contains(t, buf.String(), "\x1b[33mlevel\x1b[0m=warn \x1b[33mmessage\x1b[0m=\"a=b \\\"quoted\\\"\\n\"\n")
+	require.NotContains(t, buf.String(), `\u001b`)
+}
+
+func TestColoredKeysAreNotEscaped(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, EnableColor: true, EnableCaller: true})
+
+	l.Info("hello world", "my key", "val", "error", errors.New("a b"))
+	out := buf.String()
+	require.True(t, strings.HasPrefix(out, "\033[36mtimestamp\033[0m="))
+	require.Contains(t, out, "\033[36mcaller\033[0m=")
+	require.Contains(t, out, "\033[36m\"my key\"\033[0m=val \033[36merror\033[0m=\"a b\"\n")
+	require.NotContains(t, out, `\u001b`)
+}
+
+func TestStructuredCaller(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, EnableCaller: true, StructuredCaller: true})
+
+	l.Info("hello world", "component", "logf")
+	require.Regexp(t, `message="hello world" caller_file=\S+/log_test.go caller_line=\d+ caller_func=github.com/zerodha/logf.TestStructuredCaller component=logf\n`, buf.String())
+	require.NotContains(t, buf.String(), "caller=")
+	buf.Reset()
+
+	// In JSON, the line is a number so that it can be range queried.
+	l = New(Opts{Writer: buf, Format: FormatJSON, EnableCaller: true, StructuredCaller: true})
+	l.Info("hello world")
+
+	var out map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &out))
+	require.IsType(t, float64(0), out["caller_line"])
+	require.Greater(t, out["caller_line"], float64(0))
+	require.Regexp(t, `/log_test.go$`, out["caller_file"])
+	require.Equal(t, "github.com/zerodha/logf.TestStructuredCaller", out["caller_func"])
+}
+
+type countingStringer struct {
+	calls *int
+}
+
+func (c countingStringer) String() string {
+	*c.calls++
+	return "stringer"
+}
+
+func TestLnMethods(t *testing.T) {
+	skipWithoutDebug(t)
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Level: DebugLevel})
+
+	l.Debugln("debug", 1, true)
+	require.Contains(t, buf.String(), `level=debug message="debug 1 true"`)
+	buf.Reset()
+
+	l.Infoln("hello", "world")
+	require.Contains(t, buf.String(), `level=info message="hello world"`)
+	buf.Reset()
+
+	l.Warnln("warn", 1.5)
+	require.Contains(t, buf.String(), `level=warn message="warn 1.5"`)
+	buf.Reset()
+
+	l.Errorln("error:", errors.New("oops"))
+	require.Contains(t, buf.String(), `level=error message="error: oops"`)
+	buf.Reset()
+
+	var hadExit bool
+	exit = func(code int) {
+		hadExit = code == 1
+	}
+	l.Fatalln("fatal")
+	require.True(t, hadExit, "exit should have been called")
+	require.Contains(t, buf.String(), `level=fatal message=fatal`)
+	buf.Reset()
+
+	// Args shouldn't be formatted if the level is disabled.
+	calls := 0
+	l = New(Opts{Writer: buf, Level: ErrorLevel})
+	l.Infoln("lazy", countingStringer{&calls})
+	require.Equal(t, 0, calls)
+	require.Empty(t, buf.String())
+
+	l.Errorln("lazy", countingStringer{&calls})
+	require.Equal(t, 1, calls)
+	require.Contains(t, buf.String(), `level=error message="lazy stringer"`)
+}
+
+func TestConsoleFormat(t *testing.T) {
+	skipWithoutDebug(t)
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Format: FormatConsole, Level: DebugLevel})
+	require.Equal(t, consoleTSFormat, l.Opts.TimestampFormat, "timestamp format is time only")
+
+	l.Info("hello world", "component", "logf", "user", "karan smith")
+	require.Regexp(t, `^\d{2}:\d{2}:\d{2}\.\d{3} INFO  hello world component=logf user="karan smith"\n$`, buf.String())
+	buf.Reset()
+
+	l.Error("oops", "error", errors.New("fake"))
+	require.Regexp(t, `^\S+ ERROR oops error=fake\n$`, buf.String())
+	buf.Reset()
+
+	// Field-only logs.
+	l.Debug("", "key", "val")
+	require.Regexp(t, `^\S+ DEBUG key=val\n$`, buf.String())
+	buf.Reset()
+
+	// Custom timestamp formats are respected.
+	l = New(Opts{Writer: buf, Format: FormatConsole, TimestampFormat: "2006"})
+	l.Warn("careful")
+	require.Regexp(t, `^\d{4} WARN  careful\n$`, buf.String())
+	buf.Reset()
+
+	// The level tag is colored.
+	l = New(Opts{Writer: buf, Format: FormatConsole, EnableColor: true})
+	l.Info("hello world", "component", "logf")
+	require.Contains(t, buf.String(), " \x1b[36mINFO \x1b[0m hello world \x1b[36mcomponent\x1b[0m=logf\n")
+}
+
+func TestConsoleMessage(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Format: FormatConsole, ValueRedactor: func(key, val string) string {
+		return strings.Replace(val, "hunter2", "***", -1)
+	}})
+
+	// The message is redacted like in the other formats.
+	l.Info("password is hunter2", "pass", "hunter2")
+	require.Regexp(t, `INFO  password is \*\*\* pass=\*\*\*\n$`, buf.String())
+	buf.Reset()
+
+	// Control characters are escaped, so a message can't forge a line.
+	l.Info("hello\n12:00:00.000 ERROR forged\r\t\x1b[31m")
+	require.Equal(t, 1, strings.Count(buf.String(), "\n"))
+	require.Contains(t, buf.String(), `INFO  hello\n12:00:00.000 ERROR forged\r\t\u001b[31m`+"\n")
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Format: FormatConsole, ASCIIOnly: true})
+	l.Info("héllo\nwörld")
+	require.Contains(t, buf.String(), `INFO  h\u00e9llo\nw\u00f6rld`+"\n")
+}
+
+func TestLevelStrings(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, LevelStrings: map[Level]string{
+		InfoLevel:  "INF",
+		ErrorLevel: "ERR",
+	}})
+
+	l.Info("hello world")
+	require.Contains(t, buf.String(), `level=INF message="hello world"`)
+	buf.Reset()
+
+	l.Error("hello world")
+	require.Contains(t, buf.String(), `level=ERR message="hello world"`)
+	buf.Reset()
+
+	// Levels not overridden use the defaults.
+	l.Warn("hello world")
+	require.Contains(t, buf.String(), `level=warn message="hello world"`)
+	buf.Reset()
+
+	// Level.String() is unaffected.
+	require.Equal(t, "info", InfoLevel.String())
+	require.Equal(t, "error", ErrorLevel.String())
+}
+
+func TestLogFormatJSON(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Format: FormatJSON, EnableColor: true, EnableCaller: true,
+		DefaultFields: []interface{}{"service", "api"}})
+
+	type user struct {
+		ID   int    `json:"id"`
+		Name string `json:"name"`
+	}
+	l.Info("hello \"world\"",
+		"int", 1,
+		"uint64", uint64(1<<63),
+		"float", 1.5,
+		"bool", true,
+		"nil", nil,
+		"string", "1",
+		"bytes", []byte("b"),
+		"error", errors.New("oops"),
+		"duration", time.Second,
+		"slice", []int{1, 2},
+		"map", map[string]interface{}{"b": 2, "a": "x"},
+		"struct", user{ID: 1, Name: "karan"},
+	)
+
+	line := buf.String()
+	require.True(t, strings.HasSuffix(line, "}\n"), "line should be a JSON object")
+	require.NotContains(t, line, "\x1b", "JSON isn't colored")
+
+	var out map[string]interface{}
+	require.NoError(t, json.Unmarshal([]byte(line), &out))
+	require.Equal(t, "info", out["level"])
+	require.Equal(t, `hello "world"`, out["message"])
+	require.Contains(t, out["caller"], "log_test.go:")
+	require.Equal(t, "api", out["service"])
+	require.Equal(t, float64(1), out["int"])
+	require.Equal(t, 1.5, out["float"])
+	require.Equal(t, true, out["bool"])
+	require.Nil(t, out["nil"])
+	require.Equal(t, "1", out["string"])
+	require.Equal(t, "b", out["bytes"])
+	require.Equal(t, "oops", out["error"])
+	require.Equal(t, "1s", out["duration"])
+	require.Equal(t, []interface{}{float64(1), float64(2)}, out["slice"])
+	require.Equal(t, map[string]interface{}{"a": "x", "b": float64(2)}, out["map"])
+	require.Equal(t, map[string]interface{}{"id": float64(1), "name": "karan"}, out["struct"])
+
+	// Numbers are written without quotes, so they can be aggregated.
+	require.Contains(t, line, `,"int":1,"uint64":9223372036854775808,"float":1.5,"bool":true,"nil":null,"string":"1",`)
+	_, err := time.Parse(defaultTSFormat, out["timestamp"].(string))
+	require.NoError(t, err)
+}
+
+func TestUnsignedTypes(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+
+	l.Info("hello world", "uint", uint(1), "uint8", uint8(2), "uint16", uint16(3), "uint32", uint32(4), "uint64", uint64(5))
+	require.Contains(t, buf.String(), `uint=1 uint8=2 uint16=3 uint32=4 uint64=5`)
+}
+
+func TestWithLevel(t *testing.T) {
+	skipWithoutDebug(t)
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+
+	debug := l.WithLevel(DebugLevel)
+	debug.Debug("debug log")
+	require.Contains(t, buf.String(), `level=debug message="debug log"`)
+	buf.Reset()
+
+	// The original logger keeps its level.
+	l.Debug("debug log")
+	require.Empty(t, buf.String())
+	require.Equal(t, InfoLevel, l.Opts.Level)
+
+	l.WithLevel(ErrorLevel).Warn("warn log")
+	require.Empty(t, buf.String())
+}
+
+func TestFieldSeparator(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, FieldSeparator: "\t", DefaultFields: []interface{}{"service", "api"}})
+
+	l.Info("hello world", "key", "val", "tab", "a\tb", "newline", "a\nb")
+	require.Regexp(t, "^timestamp=\\S+\tlevel=info\tmessage=\"hello world\"\tservice=api\tkey=val\ttab=\"a\\\\tb\"\tnewline=\"a\\\\nb\"\n$", buf.String())
+	buf.Reset()
+
+	// Invalid separators fall back to the default.
+	for _, sep := range []string{"|", "=", `"`, " , "} {
+		l = New(Opts{Writer: buf, FieldSeparator: sep})
+		require.Equal(t, " ", l.Opts.FieldSeparator, "separator %q should be rejected", sep)
+	}
+
+	// JSON always uses commas.
+	l = New(Opts{Writer: buf, Format: FormatJSON, FieldSeparator: "\t"})
+	l.Info("hello world", "key", "val")
+	require.Contains(t, buf.String(), `,"level":"info","message":"hello world","key":"val"}`)
+}
+
+func TestKeyTransformer(t *testing.T) {
+	snakeCase := func(key string) string {
+		var (
+			b     strings.Builder
+			lower bool
+		)
+		for _, r := range key {
+			if r >= 'A' && r <= 'Z' {
+				if lower {
+					b.WriteByte('_')
+				}
+				r += 'a' - 'A'
+				lower = false
+			} else {
+				lower = true
+			}
+			b.WriteRune(r)
+		}
+		return b.String()
+	}
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, KeyTransformer: snakeCase, EnableCaller: true, DefaultFields: []interface{}{"serviceName", "api"}})
+
+	l.Info("hello world", "userID", 1, "requestPath", "/")
+	require.Regexp(t, `^timestamp=\S+ level=info message="hello world" caller=\S+ service_name=api user_id=1 request_path=/\n$`, buf.String())
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, KeyTransformer: strings.ToUpper})
+	l.Info("hello world", "userID", 1)
+	require.Contains(t, buf.String(), `level=info message="hello world" USERID=1`)
+}
+
+func TestNewWithScope(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := NewWithScope(buf, "db")
+
+	l.Info("hello world", "key", "val")
+	require.Contains(t, buf.String(), `level=info message="hello world" scope=db key=val`)
+	buf.Reset()
+
+	// An empty scope is omitted along with its separator.
+	l = NewWithScope(buf, "")
+	l.Info("hello world", "key", "val")
+	require.NotContains(t, buf.String(), "scope=")
+	require.Regexp(t, `^timestamp=\S+ level=info message="hello world" key=val\n$`, buf.String())
+	buf.Reset()
+
+	l.Info("hello world")
+	require.Regexp(t, `^timestamp=\S+ level=info message="hello world"\n$`, buf.String())
+}
+
+func TestNumericLevel(t *testing.T) {
+	skipWithoutDebug(t)
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, NumericLevel: true, Level: DebugLevel})
+
+	l.Error("hello world")
+	require.Contains(t, buf.String(), `level=4 message="hello world"`)
+	buf.Reset()
+
+	l.Debug("hello world")
+	require.Contains(t, buf.String(), `level=1 message="hello world"`)
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, NumericLevel: true, Format: FormatJSON})
+	l.Warn("hello world")
+	require.Contains(t, buf.String(), `"level":3,`)
+}
+
+func TestFilter(t *testing.T) {
+	buf := &bytes.Buffer{}
+
+	// Deny health checks.
+	l := New(Opts{Writer: buf, Level: DebugLevel, Filter: func(lvl Level, msg string, fields []interface{}) bool {
+		for i := 1; i < len(fields); i += 2 {
+			if fields[i-1] == "path" && fields[i] == "/healthz" {
+				return false
+			}
+		}
+		return true
+	}})
+
+	l.Info("request", "path", "/healthz")
+	require.Empty(t, buf.String())
+	l.Info("request", "path", "/users")
+	require.Contains(t, buf.String(), `message=request path=/users`)
+	buf.Reset()
+
+	// Allow only errors from the db.
+	var calls int
+	l = New(Opts{Writer: buf, Level: WarnLevel, Filter: func(lvl Level, msg string, fields []interface{}) bool {
+		calls++
+		return lvl >= ErrorLevel && len(fields) == 2 && fields[1] == "db"
+	}})
+
+	l.Info("skipped by level", "component", "db")
+	require.Equal(t, 0, calls, "filter isn't called for logs below the level")
+	l.Warn("denied", "component", "db")
+	l.Error("denied", "component", "api")
+	l.Error("allowed", "component", "db")
+	require.Equal(t, 3, calls)
+	require.Equal(t, 1, strings.Count(buf.String(), "\n"))
+	require.Contains(t, buf.String(), `message=allowed component=db`)
+}
+
+func TestSetLevelAtomic(t *testing.T) {
+	skipWithoutDebug(t)
+
+	buf := &safeBuffer{}
+	l := New(Opts{Writer: buf})
+	child := l.With("component", "db")
+	other := l.WithLevel(ErrorLevel)
+
+	l.Debug("hidden")
+	require.Empty(t, buf.String())
+
+	l.SetLevelAtomic(DebugLevel)
+	child.Debug("visible")
+	require.Contains(t, buf.String(), `message=visible component=db`)
+	other.Warn("hidden")
+	require.NotContains(t, buf.String(), "hidden")
+
+	// Concurrent logging and level changes.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				child.Debug("msg")
+				l.Infoln("msg")
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				l.SetLevelAtomic(Level(j%2 + 1))
+			}
+		}()
+	}
+	wg.Wait()
+
+	l.SetLevelAtomic(ErrorLevel)
+	n := len(buf.String())
+	child.Warn("hidden")
+	l.Infoln("hidden")
+	require.Len(t, buf.String(), n)
+}
+
+func TestNewStrict(t *testing.T) {
+	_, err := NewStrict(nil)
+	require.ErrorIs(t, err, ErrNilWriter)
+
+	var f *os.File
+	_, err = NewStrict(f)
+	require.ErrorIs(t, err, ErrNilWriter)
+
+	buf := &bytes.Buffer{}
+	l, err := NewStrict(buf)
+	require.NoError(t, err)
+	l.Info("hello world")
+	require.Contains(t, buf.String(), `level=info message="hello world"`)
+}
+
+func TestASCIIOnly(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, ASCIIOnly: true})
+
+	l.Info("héllo 😀", "city", "日本", "plain", "abc", "err", errors.New("ü"))
+	require.Contains(t, buf.String(), `message="h\u00e9llo \ud83d\ude00" city="\u65e5\u672c" plain=abc err="\u00fc"`+"\n")
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, ASCIIOnly: true, Format: FormatJSON})
+	l.Info("😀", "names", []string{"日本"})
+	require.Contains(t, buf.String(), `"message":"\ud83d\ude00","names":["\u65e5\u672c"]}`)
+
+	var out map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &out))
+	require.Equal(t, "😀", out["message"])
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, ASCIIOnly: true, Format: FormatConsole})
+	l.Info("日本", "k", "v")
+	require.Contains(t, buf.String(), `\u65e5\u672c k=v`)
+
+	for _, b := range buf.Bytes() {
+		require.Less(t, b, byte(utf8.RuneSelf))
+	}
+	buf.Reset()
+
+	// UTF-8 is written as is by default.
+	New(Opts{Writer: buf}).Info("日本", "city", "日本")
+	require.Contains(t, buf.String(), `message=日本 city=日本`)
+}
+
+func TestFatalExitCode(t *testing.T) {
+	oldExit := exit
+	defer func() { exit = oldExit }()
+
+	var code int
+	exit = func(c int) {
+		code = c
+	}
+
+	buf := &bytes.Buffer{}
+	New(Opts{Writer: buf}).Fatal("fatal")
+	require.Equal(t, 1, code)
+
+	l := New(Opts{Writer: buf, FatalExitCode: 3})
+	l.Fatal("fatal")
+	require.Equal(t, 3, code)
+	code = 0
+	l.Fatalln("fatal")
+	require.Equal(t, 3, code)
+	require.Equal(t, 3, strings.Count(buf.String(), "level=fatal"))
+}
+
+func TestExitFunc(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := NewBufferedWriter(buf, BufferedOpts{FlushLevel: FatalLevel + 1})
+
+	var (
+		code    int
+		flushed string
+	)
+	l := New(Opts{Writer: w, FatalExitCode: 2, ExitFunc: func(c int) {
+		code = c
+		flushed = buf.String()
+	}})
+
+	l.Info("first")
+	l.Fatal("fatal", "key", "val")
+	require.Equal(t, 2, code)
+	require.Contains(t, flushed, `message=first`, "the writer is flushed before exiting")
+	require.Contains(t, flushed, `level=fatal message=fatal key=val`)
+}
+
+func TestFatalAsError(t *testing.T) {
+	buf := &bytes.Buffer{}
+	exited := 0
+	l := New(Opts{Writer: buf, FatalAsError: true, ExitFunc: func(int) { exited++ }})
+
+	l.Fatal("fatal", "key", "val")
+	l.Fatalln("fatalln", 1)
+	l.Log(FatalLevel, "log")
+	l.MultiLine(FatalLevel, "multi\nline")
+	require.Equal(t, 0, exited)
+	require.Equal(t, 5, strings.Count(buf.String(), "level=error "))
+	require.NotContains(t, buf.String(), "level=fatal")
+	require.Contains(t, buf.String(), `level=error message=fatal key=val`+"\n")
+	require.Contains(t, buf.String(), `level=error message="fatalln 1"`+"\n")
+	require.Contains(t, buf.String(), `level=error message=log`+"\n")
+	require.Contains(t, buf.String(), `level=error message=line line=2`+"\n")
+}
+
+func TestMapFieldOrder(t *testing.T) {
+	m := map[string]interface{}{"zeta": 1, "alpha": "x", "mid": []int{1, 2}, "beta": map[string]int{"y": 2, "x": 1}}
+
+	// Maps are written with sorted keys, so the output is the same on
+	// every run.
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+	for i := 0; i < 20; i++ {
+		l.Info("hello", "m", m)
+		require.Contains(t, buf.String(), `message=hello m="map[alpha:x beta:map[x:1 y:2] mid:[1 2] zeta:1]"`+"\n")
+		buf.Reset()
+	}
+
+	l = New(Opts{Writer: buf, Format: FormatJSON})
+	for i := 0; i < 20; i++ {
+		l.Info("hello", "m", m)
+		require.Contains(t, buf.String(), `"m":{"alpha":"x","beta":{"x":1,"y":2},"mid":[1,2],"zeta":1}}`+"\n")
+		buf.Reset()
+	}
+}
+
+func TestDuplicateKeys(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, DefaultFields: []interface{}{"service", "api", "env", "dev", "service", "web"}})
+
+	// Repeated default fields.
+	l.Info("hello")
+	require.Contains(t, buf.String(), `message=hello env=dev service=web`+"\n")
+	buf.Reset()
+
+	// Call fields override default fields.
+	l.Info("hello", "env", "prod", "key", "val")
+	require.Contains(t, buf.String(), `message=hello service=web env=prod key=val`+"\n")
+	buf.Reset()
+
+	// The last of repeated call fields wins.
+	l.Info("hello", "key", "a", "other", "b", "key", "c")
+	require.Contains(t, buf.String(), `message=hello env=dev service=web other=b key=c`+"\n")
+	buf.Reset()
+
+	// With overrides the parent's fields.
+	l.With("env", "staging").Info("hello", "key", "val")
+	require.Contains(t, buf.String(), `message=hello service=web env=staging key=val`+"\n")
+	buf.Reset()
+
+	// A trailing odd field isn't a key.
+	l.Info("hello", "key", "val", "env")
+	require.Contains(t, buf.String(), `message=hello env=dev service=web key=val !BADKEY=env`+"\n")
+	buf.Reset()
+
+	// Different keys with the same keyBit are all written.
+	require.Equal(t, keyBit("axb"), keyBit("ayb"))
+	require.Equal(t, keyBit("env"), keyBit("eav"))
+	l.Info("hello", "axb", 1, "ayb", 2, "eav", 3)
+	require.Contains(t, buf.String(), `message=hello env=dev service=web axb=1 ayb=2 eav=3`+"\n")
+	buf.Reset()
+
+	// Same for JSON.
+	l = New(Opts{Writer: buf, Format: FormatJSON, DefaultFields: []interface{}{"env", "dev"}})
+	l.Info("hello", "env", "prod", "env", "test")
+	require.Contains(t, buf.String(), `"message":"hello","env":"test"}`+"\n")
+}
+
+func TestLevelComparison(t *testing.T) {
+	require.True(t, WarnLevel.Enabled(WarnLevel))
+	require.True(t, ErrorLevel.Enabled(WarnLevel))
+	require.False(t, InfoLevel.Enabled(WarnLevel))
+	require.True(t, DebugLevel.Enabled(DebugLevel))
+	require.True(t, FatalLevel.Enabled(DebugLevel))
+	require.False(t, ErrorLevel.Enabled(FatalLevel))
+
+	require.True(t, FatalLevel.MoreSevereThan(ErrorLevel))
+	require.True(t, InfoLevel.MoreSevereThan(DebugLevel))
+	require.False(t, WarnLevel.MoreSevereThan(WarnLevel))
+	require.False(t, DebugLevel.MoreSevereThan(InfoLevel))
+}
+
+func TestBadKey(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, DefaultFields: []interface{}{"service", "api", "orphan"}})
+
+	// The last of odd number of fields is written with !BADKEY.
+	l.Info("hello", "count", 3, "ratio", 0.5, "ok", true, "size", uint8(7), "extra")
+	require.Contains(t, buf.String(), `message=hello service=api !BADKEY=orphan count=3 ratio=0.5 ok=true size=7 !BADKEY=extra`+"\n")
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Format: FormatJSON})
+	l.Info("hello", "ok", false, "n", -1, 42)
+
+	var out map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &out))
+	require.Equal(t, false, out["ok"])
+	require.Equal(t, float64(-1), out["n"])
+	require.Equal(t, float64(42), out["!BADKEY"])
+}
+
+func TestQuoteChar(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, QuoteChar: '\''})
+
+	l.Info("hello world", "said", `"hi"`, "name", "it's", "plain", "abc")
+	require.Contains(t, buf.String(), `message='hello world' said='"hi"' name='it\'s' plain=abc`+"\n")
+	buf.Reset()
+
+	// Invalid quote characters fall back to the default.
+	l = New(Opts{Writer: buf, QuoteChar: '='})
+	l.Info("hello world")
+	require.Contains(t, buf.String(), `message="hello world"`)
+	buf.Reset()
+
+	// JSON is always double quoted.
+	l = New(Opts{Writer: buf, Format: FormatJSON, QuoteChar: '\''})
+	l.Info("it's")
+	require.Contains(t, buf.String(), `"message":"it's"}`)
+}
+
+func TestComplexAndBigValues(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+
+	var (
+		nilInt   *big.Int
+		nilFloat *big.Float
+	)
+	l.Info("hello", "c", complex(1.5, -2), "c64", complex64(complex(0, 3)), "inf", complex(math.Inf(1), math.Inf(1)),
+		"int", new(big.Int).Lsh(big.NewInt(1), 100), "float", big.NewFloat(1.25), "nil_int", nilInt, "nil_float", nilFloat)
+	require.Contains(t, buf.String(), `message=hello c=1.5-2i c64=0+3i inf=+Inf+Infi int=1267650600228229401496703205376 float=1.25 nil_int=<nil> nil_float=<nil>`+"\n")
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Format: FormatJSON})
+	l.Info("hello", "c", complex(1, 2), "int", big.NewInt(-42), "nil_float", nilFloat)
+	require.Contains(t, buf.String(), `"c":"1+2i","int":-42,"nil_float":"<nil>"}`)
+}
+
+func TestRelativeTimestamps(t *testing.T) {
+	now := time.Date(2022, 7, 7, 12, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Clock: clock, RelativeTimestamps: true})
+
+	l.Info("first")
+	now = now.Add(1500 * time.Microsecond)
+	l.Info("second")
+	now = now.Add(time.Second)
+	l.With("key", "val").Info("third")
+	require.Equal(t, "timestamp=0.000ms level=info message=first\n"+
+		"timestamp=1.500ms level=info message=second\n"+
+		"timestamp=1001.500ms level=info message=third key=val\n", buf.String())
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Clock: clock, RelativeTimestamps: true, Format: FormatConsole})
+	now = now.Add(2 * time.Millisecond)
+	l.Info("hello")
+	require.Equal(t, "2.000ms INFO  hello\n", buf.String())
+	buf.Reset()
+
+	// The clock is used for absolute timestamps too.
+	New(Opts{Writer: buf, Clock: clock, Format: FormatJSON, TimestampFormat: time.RFC3339}).Info("hello")
+	require.Equal(t, `{"timestamp":"2022-07-07T12:00:01Z","level":"info","message":"hello"}`+"\n", buf.String())
+}
+
+func TestWithDeadline(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	l.WithDeadline(ctx).Info("hello", "key", "val")
+	require.Regexp(t, `message=hello deadline_in=59m59\.\d+s key=val\n$`, buf.String())
+	buf.Reset()
+
+	// No deadline.
+	l.WithDeadline(context.Background()).Info("hello")
+	require.NotContains(t, buf.String(), "deadline_in")
+}
+
+func TestSequence(t *testing.T) {
+	buf := &safeBuffer{}
+	l := New(Opts{Writer: buf, Sequence: true, EnableCaller: true, DefaultFields: []interface{}{"app", "api"}})
+	child := l.With("component", "db")
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				if i%2 == 0 {
+					l.Info("parent")
+				} else {
+					child.Info("child")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	// Every line has a unique number. Concurrent lines may be written
+	// out of order, but the numbers have no gaps.
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 800)
+	re := regexp.MustCompile(`caller=\S+ seq=(\d+) app=api`)
+	seen := make(map[int]bool)
+	for _, line := range lines {
+		m := re.FindStringSubmatch(line)
+		require.Len(t, m, 2, line)
+		n, err := strconv.Atoi(m[1])
+		require.NoError(t, err)
+		require.False(t, seen[n], "duplicate seq %d", n)
+		seen[n] = true
+	}
+	for i := 1; i <= 800; i++ {
+		require.True(t, seen[i], "missing seq %d", i)
+	}
+
+	// The numbers increase on a goroutine.
+	buf2 := &bytes.Buffer{}
+	l = New(Opts{Writer: buf2, Sequence: true})
+	l.Info("one")
+	l.With("k", "v").Info("two")
+	require.Regexp(t, `message=one seq=1\n.*message=two seq=2 k=v\n$`, buf2.String())
+
+	// Disabled by default.
+	buf2.Reset()
+	New(Opts{Writer: buf2}).Info("hello")
+	require.NotContains(t, buf2.String(), "seq=")
+}
+
+func TestErrorErr(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, EnableCaller: true})
+
+	errRead := errors.New("eof")
+	err := l.ErrorErr("read failed", errRead, "file", "a.txt")
+	require.True(t, err == errRead, "the same error is returned")
+	require.Regexp(t, `level=error message="read failed" caller=\S+/log_test.go:\d+ file=a.txt error=eof\n$`, buf.String())
+	buf.Reset()
+
+	// Wrapped.
+	err = l.ErrorWrap("read failed", errRead)
+	require.EqualError(t, err, "read failed: eof")
+	require.ErrorIs(t, err, errRead)
+	require.Contains(t, buf.String(), `message="read failed" caller=`)
+	require.Contains(t, buf.String(), `error=eof`+"\n")
+	buf.Reset()
+
+	// Nil errors aren't logged.
+	require.NoError(t, l.ErrorErr("read failed", nil))
+	require.NoError(t, l.ErrorWrap("read failed", nil))
+	require.Empty(t, buf.String())
+}
+
+type point struct{ x, y int }
+
+func (p point) MarshalJSON() ([]byte, error) {
+	return []byte(fmt.Sprintf(`{ "x": %d, "y": %d }`, p.x, p.y)), nil
+}
+
+type badMarshaler struct{}
+
+func (badMarshaler) MarshalJSON() ([]byte, error) {
+	return nil, errors.New("bad")
+}
+
+func TestJSONMarshalerValues(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Format: FormatJSON})
+	l.Info("hello", "p", point{1, 2}, "bad", badMarshaler{})
+	require.Contains(t, buf.String(), `"p":{"x":1,"y":2},"bad":"{}"}`)
+	buf.Reset()
+
+	l = New(Opts{Writer: buf})
+	l.Info("hello", "p", point{1, 2}, "bad", badMarshaler{})
+	require.Contains(t, buf.String(), `p="{\"x\":1,\"y\":2}" bad={}`+"\n")
+}
+
+func TestTimestampFromFields(t *testing.T) {
+	buf := &bytes.Buffer{}
+	ts := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	l := New(Opts{Writer: buf, TimestampFromFields: true, TimestampFormat: time.RFC3339})
+	l.Info("imported", "timestamp", ts, "id", 1)
+	require.Equal(t, "timestamp=2020-01-02T03:04:05Z level=info message=imported id=1\n", buf.String())
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Format: FormatJSON, TimestampFromFields: true, TimestampFormat: time.RFC3339})
+	l.Info("imported", "timestamp", "yesterday", "id", 1)
+	require.Equal(t, `{"timestamp":"yesterday","level":"info","message":"imported","id":1}`+"\n", buf.String())
+	buf.Reset()
+
+	// Without a timestamp field, the current time is used.
+	l.Info("live")
+	require.Equal(t, 1, strings.Count(buf.String(), `"timestamp":`))
+	require.NotContains(t, buf.String(), "yesterday")
+}
+
+func TestMultiLine(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Format: FormatJSON, DefaultFields: []interface{}{"app", "api"}})
+	l.With("query", 7).MultiLine(ErrorLevel, "SELECT *\nFROM users\r\nWHERE id = 1\n", "db", "main")
+
+	lines := strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n")
+	require.Len(t, lines, 3)
+	for i, want := range []string{"SELECT *", "FROM users", "WHERE id = 1"} {
+		var out map[string]interface{}
+		require.NoError(t, json.Unmarshal([]byte(lines[i]), &out))
+		require.Equal(t, "error", out["level"])
+		require.Equal(t, want, out["message"])
+		require.Equal(t, float64(i+1), out["line"])
+		require.Equal(t, "api", out["app"])
+		require.Equal(t, float64(7), out["query"])
+		require.Equal(t, "main", out["db"])
+	}
+}
+
+func TestColorEnabled(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.False(t, New(Opts{Writer: buf}).ColorEnabled())
+	require.True(t, New(Opts{Writer: buf, EnableColor: true}).ColorEnabled())
+	require.True(t, New(Opts{Writer: buf, EnableColor: true, Format: FormatConsole}).ColorEnabled())
+	require.False(t, New(Opts{Writer: buf, EnableColor: true, Format: FormatJSON}).ColorEnabled())
+	require.False(t, New(Opts{Writer: buf, EnableColor: true, Encoder: JSONEncoder{}}).ColorEnabled())
+}
+
+func TestColorFromEnv(t *testing.T) {
+	buf := &bytes.Buffer{}
+	t.Setenv("NO_COLOR", "1")
+	require.False(t, New(Opts{Writer: buf, EnableColor: true}).ColorEnabled())
+
+	// NO_COLOR wins over FORCE_COLOR.
+	t.Setenv("FORCE_COLOR", "1")
+	require.False(t, New(Opts{Writer: buf, EnableColor: true}).ColorEnabled())
+
+	t.Setenv("NO_COLOR", "")
+	require.True(t, New(Opts{Writer: buf}).ColorEnabled())
+	New(Opts{Writer: buf}).Info("hello")
+	require.Contains(t, buf.String(), "\033[")
+	buf.Reset()
+
+	t.Setenv("FORCE_COLOR", "0")
+	require.False(t, New(Opts{Writer: buf, EnableColor: true}).ColorEnabled())
+
+	t.Setenv("FORCE_COLOR", "")
+	require.True(t, New(Opts{Writer: buf, EnableColor: true}).ColorEnabled())
+	require.False(t, New(Opts{Writer: buf}).ColorEnabled())
+}
+
+func TestRawValues(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Format: FormatJSON})
+	l.Info("hello", "user", Raw(`{"id":1,"tags":["a b"]}`), "bytes", []byte(`{"id":1}`))
+	require.Contains(t, buf.String(), `"user":{"id":1,"tags":["a b"]},"bytes":"{\"id\":1}"}`)
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, ValueRedactor: func(string, string) string { return "***" }})
+	l.Info("hello", "raw", Raw(`a "b" c`))
+	require.Contains(t, buf.String(), `raw=a "b" c`+"\n")
+}
+
+func TestLineEnding(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, LineEnding: "\r\n"})
+	l.Info("one")
+	l.Info("two")
+	require.Equal(t, 2, strings.Count(buf.String(), "\r\n"))
+	require.True(t, strings.HasSuffix(buf.String(), "message=two\r\n"))
+	buf.Reset()
+
+	// Invalid line endings fall back to the default.
+	l = New(Opts{Writer: buf, Format: FormatJSON, LineEnding: ";"})
+	l.Info("one")
+	require.True(t, strings.HasSuffix(buf.String(), `"message":"one"}`+"\n"))
+}
+
+func TestWithOrderedFields(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, DefaultFields: []interface{}{"app", "api"}})
+	l.WithOrderedFields(OrderedFields{{"zone", "b"}, {"id", 2}, {"method", "GET"}}).Info("hello", "status", 200)
+	require.Contains(t, buf.String(), `message=hello app=api zone=b id=2 method=GET status=200`+"\n")
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Format: FormatJSON})
+	l.WithOrderedFields(OrderedFields{{"zone", "b"}, {"id", 2}, {"method", "GET"}}).Info("hello")
+	require.Contains(t, buf.String(), `"message":"hello","zone":"b","id":2,"method":"GET"}`+"\n")
+}
+
+func TestWithFieldSets(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, DefaultFields: []interface{}{"app", "api"}})
+
+	common := OrderedFields{{"zone", "b"}, {"id", 1}}
+	req := OrderedFields{{"method", "GET"}, {"zone", "c"}}
+	l.WithFieldSets(common, req, F("id", 2), nil, F("app", "web")).Info("hello")
+	require.Contains(t, buf.String(), `message=hello method=GET zone=c id=2 app=web`+"\n")
+	buf.Reset()
+
+	l.WithFieldSets().Info("hello")
+	require.Contains(t, buf.String(), `message=hello app=api`+"\n")
+}
+
+type panicStringer struct{}
+
+func (panicStringer) String() string { panic("boom") }
+
+type panicMarshaler struct{}
+
+func (panicMarshaler) MarshalJSON() ([]byte, error) { panic("boom") }
+
+type panicError struct{}
+
+func (panicError) Error() string { panic("boom") }
+
+func TestPanickingValues(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+	require.NotPanics(t, func() {
+		l.Info("hello", "s", panicStringer{}, "m", panicMarshaler{}, "e", panicError{}, "ok", 1)
+	})
+	require.Contains(t, buf.String(), `message=hello s=!PANIC(boom) m=!PANIC(boom) e=!PANIC(boom) ok=1`+"\n")
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Format: FormatJSON})
+	require.NotPanics(t, func() {
+		l.Info("hello", "s", panicStringer{}, "m", []interface{}{panicMarshaler{}}, "ok", 1)
+	})
+	require.Contains(t, buf.String(), `"s":"!PANIC(boom)","m":"!PANIC(boom)","ok":1}`)
+}
+
+func TestCallerMinLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, EnableCaller: true, CallerMinLevel: WarnLevel})
+	l.Info("info")
+	require.NotContains(t, buf.String(), "caller=")
+	buf.Reset()
+
+	l.Warn("warn")
+	require.Contains(t, buf.String(), "caller=")
+	buf.Reset()
+
+	l.Error("error")
+	require.Contains(t, buf.String(), "caller=")
+}
+
+func TestLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	exited := 0
+	l := New(Opts{Writer: buf, Level: DebugLevel, ExitFunc: func(int) { exited++ }})
+
+	for _, lvl := range []Level{DebugLevel, InfoLevel, WarnLevel, ErrorLevel} {
+		buf.Reset()
+		l.Log(lvl, "hello", "key", "val")
+		require.Contains(t, buf.String(), "level="+lvl.String()+" message=hello key=val\n")
+	}
+	require.Zero(t, exited)
+
+	buf.Reset()
+	l.Log(FatalLevel, "hello")
+	require.Contains(t, buf.String(), "level=fatal message=hello\n")
+	require.Equal(t, 1, exited)
+
+	// Levels below the minimum aren't logged.
+	buf.Reset()
+	l.WithLevel(ErrorLevel).Log(WarnLevel, "hello")
+	require.Empty(t, buf.String())
+}
+
+func TestLogInvalidLevel(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, EnableColor: true})
+	require.NotPanics(t, func() {
+		l.Log(Level(99), "hello")
+		l.Log(Level(-1), "hello")
+		l.WriteEntries([]Entry{{Level: Level(99), Message: "entry"}})
+		l.MultiLine(Level(99), "multi")
+	})
+	require.Equal(t, 4, strings.Count(buf.String(), "info"))
+}
+
+func TestEncodeInvalidLevel(t *testing.T) {
+	l := New(Opts{Writer: &bytes.Buffer{}})
+	require.NotPanics(t, func() {
+		require.Contains(t, string(l.Encode(Level(9), "hello")), "level=info message=hello\n")
+		require.Contains(t, string(l.Encode(Level(-1), "hello")), "level=info message=hello\n")
+	})
+}
+
+func TestLevelColorOutOfRange(t *testing.T) {
+	l := New(Opts{Writer: &bytes.Buffer{}, EnableColor: true, Format: FormatConsole})
+	buf := &byteBuffer{}
+	require.NotPanics(t, func() {
+		enc := *l.encs[InfoLevel].(*LogfmtEncoder)
+		enc.lvl = Level(99)
+		buf.B = enc.AppendKey(buf.B, "key", true)
+		l.writeConsolePrefixToBuf(buf, "hello", Level(99))
+	})
+	out := string(buf.Bytes())
+	require.True(t, strings.HasPrefix(out, "key"+reset+"="))
+	require.Contains(t, out, "?????"+reset+" hello")
+	require.Equal(t, "", levelColor(Level(-1)))
+	require.Equal(t, red, levelColor(ErrorLevel))
+}
+
+func TestVersion(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Version: "v1.2.0-3f2a1c", DefaultFields: []interface{}{"app", "api"}})
+	l.Info("one")
+	l.With("id", 1).Error("two")
+	require.Contains(t, buf.String(), "message=one version=v1.2.0-3f2a1c app=api\n")
+	require.Contains(t, buf.String(), "message=two version=v1.2.0-3f2a1c app=api id=1\n")
+}
+
+func TestMaxFields(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, MaxFields: 2, DefaultFields: []interface{}{"app", "api"}})
+
+	fields := make([]interface{}, 0, 20)
+	for i := 0; i < 10; i++ {
+		fields = append(fields, "k"+strconv.Itoa(i), i)
+	}
+	l.Info("hello", fields...)
+	require.Contains(t, buf.String(), "message=hello app=api k0=0 k1=1 fields_truncated=8\n")
+	buf.Reset()
+
+	// The odd value without a key counts as a field.
+	l.Info("hello", "a", 1, "b", 2, "c")
+	require.Contains(t, buf.String(), "message=hello app=api a=1 b=2 fields_truncated=1\n")
+	buf.Reset()
+
+	l.Info("hello", "a", 1, "b", 2)
+	require.Contains(t, buf.String(), "message=hello app=api a=1 b=2\n")
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, MaxFields: 1, Encoder: JSONEncoder{}})
+	l.Info("hello", "a", 1, "b", 2)
+	require.Contains(t, buf.String(), `"message":"hello","a":1,"fields_truncated":1}`)
+}
+
+func TestReplaceWriter(t *testing.T) {
+	var (
+		first  = &safeBuffer{}
+		second = &safeBuffer{}
+		l      = New(Opts{Writer: first})
+		child  = l.With("child", true)
+		wg     sync.WaitGroup
+	)
+
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				child.Info("hello", "j", j)
+			}
+		}()
+	}
+
+	time.Sleep(time.Millisecond)
+	old := l.ReplaceWriter(second)
+	wg.Wait()
+	require.Equal(t, first, old)
+
+	// Every line is written whole to one of the writers.
+	lines := strings.Split(strings.TrimSuffix(first.String()+second.String(), "\n"), "\n")
+	require.Len(t, lines, 800)
+	for _, line := range lines {
+		require.Regexp(t, `^timestamp=\S+ level=info message=hello child=true j=\d+$`, line)
+	}
+
+	n := len(first.String())
+	child.Info("after")
+	require.Len(t, first.String(), n)
+	require.Contains(t, second.String(), "message=after")
+}
+
+func TestAlertHook(t *testing.T) {
+	type alert struct {
+		lvl    Level
+		msg    string
+		fields []interface{}
+	}
+	alerts := make(chan alert, 10)
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Level: DebugLevel, DefaultFields: []interface{}{"app", "api"}, AlertHook: func(lvl Level, msg string, fields []interface{}) {
+		alerts <- alert{lvl, msg, fields}
+		if msg == "panic" {
+			panic("oops")
+		}
+	}})
+
+	l.Debug("debug")
+	l.Info("info")
+	l.Warn("warn")
+	l.Error("error", "code", 500)
+	l.Error("panic")
+	l.WriteEntries([]Entry{{Level: InfoLevel, Message: "entry"}, {Level: ErrorLevel, Message: "entry error"}})
+
+	got := map[string]alert{}
+	for i := 0; i < 3; i++ {
+		select {
+		case a := <-alerts:
+			got[a.msg] = a
+		case <-time.After(time.Second):
+			t.Fatal("alert hook not called")
+		}
+	}
+	require.Equal(t, alert{ErrorLevel, "error", []interface{}{"code", 500}}, got["error"])
+	require.Contains(t, got, "panic")
+	require.Contains(t, got, "entry error")
+
+	select {
+	case a := <-alerts:
+		t.Fatalf("unexpected alert: %v", a)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// The level can be lowered.
+	l = New(Opts{Writer: buf, AlertLevel: WarnLevel, AlertHook: func(lvl Level, msg string, fields []interface{}) {
+		alerts <- alert{lvl, msg, fields}
+	}})
+	l.Warn("warn")
+	require.Equal(t, WarnLevel, (<-alerts).lvl)
+}
+
+func TestWithCaller(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+	l.WithCaller("handler.go:99").Error("failed")
+	require.Contains(t, buf.String(), "message=failed caller=handler.go:99\n")
+	buf.Reset()
+
+	// It replaces the looked up caller, also with StructuredCaller.
+	l = New(Opts{Writer: buf, Format: FormatJSON, EnableCaller: true, StructuredCaller: true})
+	l.WithCaller("handler.go:99").With("id", 1).Info("hello")
+	require.Contains(t, buf.String(), `"message":"hello","caller":"handler.go:99","id":1}`)
+	require.NotContains(t, buf.String(), "log_test.go")
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Encoder: LogfmtEncoder{}})
+	l.WithCaller("handler.go:99").Info("hello")
+	require.Contains(t, buf.String(), "message=hello caller=handler.go:99\n")
+}
+
+func TestKnownKeys(t *testing.T) {
+	now := time.Date(2022, 7, 7, 12, 0, 0, 0, time.UTC)
+	for _, opts := range []Opts{
+		{},
+		{EnableColor: true},
+		{Format: FormatJSON},
+		{ASCIIOnly: true, QuoteChar: '\''},
+	} {
+		buf := &bytes.Buffer{}
+		opts.Writer = buf
+		opts.Clock = func() time.Time { return now }
+		New(opts).With("status", 1).Error("hello", "request_id", 1, "a key", "x", "ключ", 2)
+		want := buf.String()
+
+		// The output is the same with the keys escaped upfront.
+		buf.Reset()
+		opts.KnownKeys = []string{"status", "request_id", "a key", "ключ"}
+		New(opts).With("status", 1).Error("hello", "request_id", 1, "a key", "x", "ключ", 2)
+		require.Equal(t, want, buf.String())
+	}
+}
+
+func TestKeyColors(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, EnableColor: true, DefaultFields: []interface{}{"app", "api"},
+		KeyColors: map[string]string{"error": red, "app": "\033[1;34m", "bad": "\033[2J\033[31m"}})
+	l.Info("hello", "error", "oops", "bad", 1, "ok", true)
+	require.Contains(t, buf.String(), "\033[1;34mapp"+reset+"=api "+red+"error"+reset+"=oops "+cyan+"bad"+reset+"=1 "+cyan+"ok"+reset+"=true\n")
+	buf.Reset()
+
+	// Key colors don't apply without color.
+	l = New(Opts{Writer: buf, KeyColors: map[string]string{"error": red}})
+	l.Info("hello", "error", "oops")
+	require.NotContains(t, buf.String(), "\033")
+}
+
+func TestSetQuiet(t *testing.T) {
+	var (
+		buf     = &bytes.Buffer{}
+		alerts  int32
+		filters int
+	)
+	l := New(Opts{
+		Writer:    buf,
+		Filter:    func(Level, string, []interface{}) bool { filters++; return true },
+		AlertHook: func(Level, string, []interface{}) { atomic.AddInt32(&alerts, 1) },
+	})
+	child := l.With("child", true).WithLevel(DebugLevel)
+
+	l.SetQuiet(true)
+	l.Error("error")
+	child.Debug("debug")
+	child.WriteEntries([]Entry{{Level: ErrorLevel, Message: "entry"}})
+	require.Empty(t, buf.String())
+	require.Zero(t, filters)
+
+	l.SetQuiet(false)
+	child.Info("info")
+	require.Contains(t, buf.String(), "message=info child=true")
+	require.Equal(t, 1, filters)
+
+	time.Sleep(10 * time.Millisecond)
+	require.Zero(t, atomic.LoadInt32(&alerts))
+}
+
+func TestBareTimestamp(t *testing.T) {
+	now := time.Date(2022, 7, 7, 12, 0, 0, 0, time.UTC)
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, BareTimestamp: true, TimestampFormat: time.RFC3339, Clock: func() time.Time { return now }})
+	l.Info("hello", "id", 1)
+	require.Equal(t, "2022-07-07T12:00:00Z level=info message=hello id=1\n", buf.String())
+	buf.Reset()
+
+	// The key is always written in JSON.
+	l = New(Opts{Writer: buf, Format: FormatJSON, BareTimestamp: true, TimestampFormat: time.RFC3339, Clock: func() time.Time { return now }})
+	l.Info("hello")
+	require.Equal(t, `{"timestamp":"2022-07-07T12:00:00Z","level":"info","message":"hello"}`+"\n", buf.String())
+}
+
+func TestNonFiniteFloats(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+	l.Info("floats", "nan", math.NaN(), "inf", math.Inf(1), "-inf", float32(math.Inf(-1)), "f", 1.5)
+	require.Contains(t, buf.String(), `nan="NaN" inf="+Inf" -inf="-Inf" f=1.5`+"\n")
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Format: FormatJSON})
+	l.Info("floats", "nan", math.NaN(), "inf", math.Inf(1), "-inf", float32(math.Inf(-1)), "f", 1.5)
+	require.Contains(t, buf.String(), `"nan":"NaN","inf":"+Inf","-inf":"-Inf","f":1.5}`+"\n")
+	require.True(t, json.Valid(buf.Bytes()))
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Format: FormatJSON, NullNonFinite: true})
+	l.Info("floats", "nan", math.NaN(), "inf", math.Inf(1), "-inf", float32(math.Inf(-1)), "f", 1.5)
+	require.Contains(t, buf.String(), `"nan":null,"inf":null,"-inf":null,"f":1.5}`+"\n")
+	require.True(t, json.Valid(buf.Bytes()))
+	buf.Reset()
+
+	// Encoders quote them too.
+	require.Equal(t, `"NaN"`, string(JSONEncoder{}.AppendFloat(nil, math.NaN(), 64)))
+	require.Equal(t, `"-Inf"`, string(LogfmtEncoder{}.AppendFloat(nil, math.Inf(-1), 64)))
+}
+
+func TestChanAndFuncValues(t *testing.T) {
+	var nilFn func(string) error
+	fields := []interface{}{"ch", make(chan int), "fn", func() {}, "nil_fn", nilFn, "recv", make(<-chan struct{})}
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+	l.Info("hello", fields...)
+	require.Contains(t, buf.String(), `ch="chan int" fn=func() nil_fn="(func(string) error)(nil)" recv="<-chan struct {}"`+"\n")
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Format: FormatJSON})
+	l.Info("hello", fields...)
+	require.Contains(t, buf.String(), `"ch":"chan int","fn":"func()","nil_fn":"(func(string) error)(nil)","recv":"<-chan struct {}"}`+"\n")
+}
+
+// shortWriter writes at most max bytes per call without an error.
+type shortWriter struct {
+	bytes.Buffer
+	max   int
+	calls int
+}
+
+func (w *shortWriter) Write(p []byte) (int, error) {
+	w.calls++
+	if len(p) > w.max {
+		p = p[:w.max]
+	}
+	return w.Buffer.Write(p)
+}
+
+// stuckWriter writes nothing and reports no error.
+type stuckWriter struct{}
+
+func (stuckWriter) Write(p []byte) (int, error) { return 0, nil }
+
+func TestShortWrites(t *testing.T) {
+	w := &shortWriter{max: 8}
+	l := New(Opts{Writer: w})
+	l.Info("a line longer than eight bytes", "id", 1)
+	require.Contains(t, w.String(), "level=info message=\"a line longer than eight bytes\" id=1\n")
+	require.Greater(t, w.calls, 1)
+
+	n, err := writeFull(stuckWriter{}, []byte("hello"))
+	require.Equal(t, 0, n)
+	require.ErrorIs(t, err, io.ErrShortWrite)
+}
+
+// failingWriter fails every write.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("broken pipe") }
+
+func TestErrorWriter(t *testing.T) {
+	for _, f := range []Format{FormatLogfmt, FormatJSON} {
+		errBuf := &bytes.Buffer{}
+		l := New(Opts{Writer: failingWriter{}, Format: f, ErrorWriter: errBuf})
+		l.Warn("hello", "data", strings.Repeat("x", 500))
+
+		line := errBuf.String()
+		require.Equal(t, 1, strings.Count(line, "\n"))
+		if f == FormatJSON {
+			var v map[string]interface{}
+			require.NoError(t, json.Unmarshal([]byte(line), &v))
+			require.Equal(t, "error", v["level"])
+			require.Equal(t, "error logging", v["message"])
+			require.Equal(t, "broken pipe", v["error"])
+			require.Equal(t, "warn", v["log_level"])
+			require.Len(t, v["line"], maxFailedLine)
+			require.True(t, strings.HasPrefix(v["line"].(string), `{"timestamp":`))
+			continue
+		}
+		require.Contains(t, line, `level=error message="error logging" error="broken pipe" log_level=warn line="timestamp=`)
+		require.Contains(t, line, `level=warn message=hello data=xxx`)
+		require.NotContains(t, line, strings.Repeat("x", 500))
+	}
+
+	// Batches written with WriteEntries are reported too.
+	errBuf := &bytes.Buffer{}
+	l := New(Opts{Writer: failingWriter{}, ErrorWriter: errBuf})
+	l.WriteEntries([]Entry{{Level: InfoLevel, Message: "one"}, {Level: WarnLevel, Message: "two"}})
+	require.Contains(t, errBuf.String(), `level=error message="error logging" error="broken pipe" log_level=warn line="timestamp=`)
+
+	// And failed flushes.
+	errBuf.Reset()
+	l = New(Opts{Writer: failingFlusher{}, ErrorWriter: errBuf, ExitFunc: func(int) {}})
+	l.Fatal("boom")
+	require.Contains(t, errBuf.String(), `level=error message="error flushing" error="flush failed"`+"\n")
+}
+
+// failingFlusher writes to nowhere and fails to flush.
+type failingFlusher struct{}
+
+func (failingFlusher) Write(p []byte) (int, error) { return len(p), nil }
+
+func (failingFlusher) Flush() error { return errors.New("flush failed") }
+
+type failingValuer struct{}
+
+func (failingValuer) Value() (driver.Value, error) { return nil, errors.New("no value") }
+
+func TestValuerValues(t *testing.T) {
+	fields := []interface{}{
+		"name", sql.NullString{String: "alice", Valid: true}, "nick", sql.NullString{},
+		"age", sql.NullInt64{Int64: 30, Valid: true}, "score", sql.NullFloat64{},
+		"ok", sql.NullBool{Bool: true, Valid: true}, "bad", failingValuer{}, "nil", (*sql.NullString)(nil),
+	}
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+	l.Info("row", fields...)
+	require.Contains(t, buf.String(), `name=alice nick=null age=30 score=null ok=true bad="no value" nil=<nil>`+"\n")
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Format: FormatJSON})
+	l.Info("row", fields...)
+	require.Contains(t, buf.String(), `"name":"alice","nick":null,"age":30,"score":null,"ok":true,"bad":"no value","nil":"<nil>"}`+"\n")
+}
+
+// skipWithoutDebug skips tests that log with Debug when it's compiled out
+// with the logf_nodebug tag.
+func skipWithoutDebug(t *testing.T) {
+	buf := &bytes.Buffer{}
+	New(Opts{Writer: buf, Level: DebugLevel}).Debug("probe")
+	if buf.Len() == 0 {
+		t.Skip("Debug is compiled out with logf_nodebug")
+	}
+}
+
+// multiErr is a multi-error like the ones returned by errors.Join, which
+// needs go1.20.
+type multiErr []error
+
+func (m multiErr) Error() string   { return "multiple errors" }
+func (m multiErr) Unwrap() []error { return m }
+
+func TestJoinedErrors(t *testing.T) {
+	err := multiErr{errors.New("dial failed"), errors.New("retry failed"), fmt.Errorf("giving up: %w", errors.New("timeout"))}
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+	l.Error("request failed", "error", err, "id", 1)
+	require.Contains(t, buf.String(), `message="request failed" error.0="dial failed" error.1="retry failed" error.2="giving up: timeout" id=1`+"\n")
+	buf.Reset()
+
+	l = New(Opts{Writer: buf, Format: FormatJSON})
+	l.ErrorErr("request failed", err)
+	require.Contains(t, buf.String(), `"message":"request failed","error":["dial failed","retry failed","giving up: timeout"]}`)
+	buf.Reset()
+
+	// Nested joins are flattened in logfmt.
+	l = New(Opts{Writer: buf})
+	l.Error("request failed", "error", multiErr{errors.New("a"), multiErr{errors.New("b"), errors.New("c")}})
+	require.Contains(t, buf.String(), `error.0=a error.1.0=b error.1.1=c`+"\n")
+}
@@ -0,0 +1,49 @@
+package logfhttp
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+)
+
+const (
+	headerPrefix = "header."
+	redacted     = "[REDACTED]"
+)
+
+// sensitiveHeaders are the canonical names of headers whose values are
+// masked by HeaderFields.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Proxy-Authorization": true,
+	"Cookie":              true,
+	"Set-Cookie":          true,
+}
+
+// HeaderFields returns the headers as header.<Name>=<value> fields, sorted
+// by name, with the values of credential headers (Authorization, Cookie,
+// Set-Cookie) masked. Multiple values of a header are joined with ", ".
+// The fields go through the logger's ValueRedactor like any other, so
+// other headers can be redacted there. eg:
+//
+//	Opts{Fields: func(r *http.Request) []interface{} {
+//		return logfhttp.HeaderFields(r.Header)
+//	}}
+func HeaderFields(h http.Header) []interface{} {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	fields := make([]interface{}, 0, len(names)*2)
+	for _, name := range names {
+		val := redacted
+		if !sensitiveHeaders[http.CanonicalHeaderKey(name)] {
+			val = strings.Join(h[name], ", ")
+		}
+		fields = append(fields, headerPrefix+name, val)
+	}
+
+	return fields
+}
@@ -0,0 +1,33 @@
+package logfhttp
+
+import (
+	"bytes"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zerodha/logf"
+)
+
+func TestHeaderFields(t *testing.T) {
+	h := http.Header{}
+	h.Set("Authorization", "Bearer secret")
+	h.Set("Cookie", "session=secret")
+	h.Set("User-Agent", "test")
+	h.Add("Accept", "text/html")
+	h.Add("Accept", "application/json")
+	h.Set("X-Api-Key", "secret")
+
+	buf := &bytes.Buffer{}
+	l := logf.New(logf.Opts{Writer: buf, ValueRedactor: func(key, val string) string {
+		if key == "header.X-Api-Key" {
+			return "***"
+		}
+		return val
+	}})
+	l.Info("request", HeaderFields(h)...)
+
+	require.Contains(t, buf.String(), `message=request header.Accept="text/html, application/json" header.Authorization=[REDACTED] header.Cookie=[REDACTED] header.User-Agent=test header.X-Api-Key=***`+"\n")
+	require.NotContains(t, buf.String(), "secret")
+	require.Empty(t, HeaderFields(nil))
+}
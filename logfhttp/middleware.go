@@ -0,0 +1,147 @@
+// Package logfhttp provides an HTTP middleware that logs every request
+// with a logf.Logger.
+package logfhttp
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/zerodha/logf"
+)
+
+const defaultMessage = "request"
+
+// Opts represents the config options for the middleware.
+type Opts struct {
+	// Message of the log line. Defaults to "request".
+	Message string
+
+	// Level returns the level to log a request at for the response
+	// status. Defaults to error for 5xx and info for everything else.
+	Level func(status int) logf.Level
+
+	// Fields, if set, returns extra fields to log for the request, after
+	// the default ones.
+	Fields func(r *http.Request) []interface{}
+}
+
+// Middleware returns a middleware that emits one log per request with the
+// method, path, status, duration and bytes written.
+func Middleware(l logf.Logger) func(http.Handler) http.Handler {
+	return MiddlewareWithOpts(l, Opts{})
+}
+
+// MiddlewareWithOpts is the same as Middleware with custom options.
+func MiddlewareWithOpts(l logf.Logger, opts Opts) func(http.Handler) http.Handler {
+	if opts.Message == "" {
+		opts.Message = defaultMessage
+	}
+	if opts.Level == nil {
+		opts.Level = defaultLevel
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			var (
+				start = time.Now()
+				sw    = &statusWriter{ResponseWriter: w, status: http.StatusOK}
+			)
+
+			next.ServeHTTP(sw, r)
+
+			fields := []interface{}{
+				"method", r.Method,
+				"path", r.URL.Path,
+				"status", sw.status,
+				"duration", time.Since(start),
+				"bytes", sw.bytes,
+			}
+			if opts.Fields != nil {
+				fields = append(fields, opts.Fields(r)...)
+			}
+
+			switch opts.Level(sw.status) {
+			case logf.DebugLevel:
+				l.Debug(opts.Message, fields...)
+			case logf.WarnLevel:
+				l.Warn(opts.Message, fields...)
+			case logf.ErrorLevel, logf.FatalLevel:
+				l.Error(opts.Message, fields...)
+			default:
+				l.Info(opts.Message, fields...)
+			}
+		})
+	}
+}
+
+// defaultLevel logs server errors at error level and everything else at info.
+func defaultLevel(status int) logf.Level {
+	if status >= http.StatusInternalServerError {
+		return logf.ErrorLevel
+	}
+	return logf.InfoLevel
+}
+
+// statusWriter is a http.ResponseWriter that records the status code and
+// the number of bytes written.
+type statusWriter struct {
+	http.ResponseWriter
+	status      int
+	bytes       int
+	wroteHeader bool
+}
+
+func (w *statusWriter) WriteHeader(status int) {
+	if !w.wroteHeader {
+		w.status = status
+		w.wroteHeader = true
+	}
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *statusWriter) Write(b []byte) (int, error) {
+	w.wroteHeader = true
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+// Flush implements http.Flusher if the underlying ResponseWriter does.
+func (w *statusWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack implements http.Hijacker if the underlying ResponseWriter does,
+// eg: for websockets. A hijacked request without a status is logged with
+// 101 Switching Protocols.
+func (w *statusWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("logfhttp: ResponseWriter doesn't support hijacking")
+	}
+
+	conn, rw, err := h.Hijack()
+	if err == nil && !w.wroteHeader {
+		w.status = http.StatusSwitchingProtocols
+		w.wroteHeader = true
+	}
+	return conn, rw, err
+}
+
+// Push implements http.Pusher if the underlying ResponseWriter does.
+func (w *statusWriter) Push(target string, opts *http.PushOptions) error {
+	if p, ok := w.ResponseWriter.(http.Pusher); ok {
+		return p.Push(target, opts)
+	}
+	return http.ErrNotSupported
+}
+
+// Unwrap returns the underlying ResponseWriter, for http.ResponseController.
+func (w *statusWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
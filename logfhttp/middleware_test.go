@@ -0,0 +1,109 @@
+package logfhttp
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zerodha/logf"
+)
+
+func TestMiddleware(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := logf.New(logf.Opts{Writer: buf})
+
+	h := Middleware(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/users?id=1", nil))
+	require.Equal(t, "hello", rec.Body.String())
+	require.Regexp(t, `level=info message=request method=GET path=/users status=200 duration=\S+ bytes=5\n$`, buf.String())
+}
+
+func TestMiddlewareLevels(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := logf.New(logf.Opts{Writer: buf})
+
+	h := Middleware(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		// Later calls shouldn't change the recorded status.
+		w.WriteHeader(http.StatusOK)
+	}))
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodPost, "/", nil))
+	require.Regexp(t, `level=error message=request method=POST path=/ status=502 duration=\S+ bytes=0\n$`, buf.String())
+}
+
+func TestMiddlewareWithOpts(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := logf.New(logf.Opts{Writer: buf, Level: logf.DebugLevel})
+
+	h := MiddlewareWithOpts(l, Opts{
+		Message: "http",
+		Level: func(status int) logf.Level {
+			if status == http.StatusNotFound {
+				return logf.WarnLevel
+			}
+			return logf.DebugLevel
+		},
+		Fields: func(r *http.Request) []interface{} {
+			return []interface{}{"user_agent", r.UserAgent()}
+		},
+	})(http.NotFoundHandler())
+
+	r := httptest.NewRequest(http.MethodGet, "/missing", nil)
+	r.Header.Set("User-Agent", "test")
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	require.Regexp(t, `level=warn message=http method=GET path=/missing status=404 duration=\S+ bytes=\d+ user_agent=test\n$`, buf.String())
+}
+
+func TestMiddlewareHijack(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := logf.New(logf.Opts{Writer: buf})
+
+	h := Middleware(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, err := w.(http.Hijacker).Hijack()
+		require.NoError(t, err)
+		defer conn.Close()
+
+		rw.WriteString("HTTP/1.1 101 Switching Protocols\r\nUpgrade: test\r\nConnection: Upgrade\r\n\r\nhello")
+		rw.Flush()
+	}))
+
+	done := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(done)
+		h.ServeHTTP(w, r)
+	}))
+	defer srv.Close()
+
+	req, err := http.NewRequest(http.MethodGet, srv.URL+"/ws", nil)
+	require.NoError(t, err)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "test")
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusSwitchingProtocols, resp.StatusCode)
+
+	b, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	require.Equal(t, "hello", string(b))
+
+	<-done
+	require.Regexp(t, `level=info message=request method=GET path=/ws status=101 duration=\S+ bytes=0\n$`, buf.String())
+
+	// Writers that can't be hijacked return an error.
+	rec := httptest.NewRecorder()
+	Middleware(l)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _, err := w.(http.Hijacker).Hijack()
+		require.Error(t, err)
+
+		require.Equal(t, http.ResponseWriter(rec), w.(interface{ Unwrap() http.ResponseWriter }).Unwrap())
+		require.Equal(t, http.ErrNotSupported, w.(http.Pusher).Push("/style.css", nil))
+	})).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+}
@@ -0,0 +1,306 @@
+// Package logfparse reads back logfmt lines written by a logf.Logger, for
+// tools that consume them, eg: tailers and test harnesses.
+//
+//	s := logfparse.NewScanner(os.Stdin, logfparse.Opts{})
+//	for s.Scan() {
+//		e := s.Entry()
+//		fmt.Println(e.Level, e.Message)
+//	}
+//	if err := s.Err(); err != nil {
+//		...
+//	}
+//
+// Lines in the console format, with colors or encoded with an Encoder
+// can't be read.
+package logfparse
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"strconv"
+	"time"
+	"unicode/utf16"
+	"unicode/utf8"
+
+	"github.com/zerodha/logf"
+)
+
+const (
+	tsKey     = "timestamp"
+	levelKey  = "level"
+	msgKey    = "message"
+	scopeKey  = "scope"
+	callerKey = "caller"
+
+	// Same as the logger's default.
+	defaultTSFormat = "2006-01-02T15:04:05.999Z07:00"
+
+	// Longest line that can be read by default.
+	defaultMaxLineSize = 1 << 20
+)
+
+// Opts represents the config options for the scanner. They should match
+// the ones of the logger that wrote the lines.
+type Opts struct {
+	// TimestampFormat of the timestamp field. Defaults to the logger's
+	// default.
+	TimestampFormat string
+
+	// QuoteChar values are quoted with. Defaults to '"'.
+	QuoteChar byte
+
+	// MaxLineSize is the longest line that can be read. Defaults to 1MB.
+	MaxLineSize int
+}
+
+// Entry is a parsed log line. Timestamp, Level, Message, Scope and Caller
+// are the zero value if their field isn't in the line.
+type Entry struct {
+	Timestamp time.Time
+	Level     logf.Level
+	Message   string
+	Scope     string
+	Caller    string
+
+	// The rest of the fields in the order they're in the line. Values
+	// are the unquoted strings.
+	Fields logf.OrderedFields
+}
+
+// Scanner reads entries from a stream of logfmt lines, one at a time,
+// like bufio.Scanner. Empty lines are skipped. Scanning stops at the
+// first line that can't be parsed.
+type Scanner struct {
+	s     *bufio.Scanner
+	opts  Opts
+	entry Entry
+	line  int
+	err   error
+}
+
+// NewScanner returns a Scanner reading from r.
+func NewScanner(r io.Reader, opts Opts) *Scanner {
+	if opts.TimestampFormat == "" {
+		opts.TimestampFormat = defaultTSFormat
+	}
+	if opts.QuoteChar == 0 {
+		opts.QuoteChar = '"'
+	}
+	if opts.MaxLineSize <= 0 {
+		opts.MaxLineSize = defaultMaxLineSize
+	}
+
+	s := bufio.NewScanner(r)
+	s.Buffer(nil, opts.MaxLineSize)
+	return &Scanner{s: s, opts: opts}
+}
+
+// Scan reads the next entry, which is then available through Entry. It
+// returns false at the end of the input or on an error.
+func (s *Scanner) Scan() bool {
+	if s.err != nil {
+		return false
+	}
+
+	for s.s.Scan() {
+		s.line++
+		line := bytes.TrimRight(s.s.Bytes(), "\r")
+		if len(bytes.TrimSpace(line)) == 0 {
+			continue
+		}
+
+		e, err := Parse(line, s.opts)
+		if err != nil {
+			s.err = fmt.Errorf("logfparse: line %d: %v", s.line, err)
+			return false
+		}
+		s.entry = e
+		return true
+	}
+
+	s.err = s.s.Err()
+	return false
+}
+
+// Entry returns the entry read by the last call to Scan.
+func (s *Scanner) Entry() Entry {
+	return s.entry
+}
+
+// Err returns the first error, if any, other than io.EOF.
+func (s *Scanner) Err() error {
+	return s.err
+}
+
+// Parse parses a single logfmt line, without the line ending.
+func Parse(line []byte, opts Opts) (Entry, error) {
+	if opts.TimestampFormat == "" {
+		opts.TimestampFormat = defaultTSFormat
+	}
+	if opts.QuoteChar == 0 {
+		opts.QuoteChar = '"'
+	}
+
+	var e Entry
+	for i := 0; i < len(line); {
+		if isFieldSep(line[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		for i < len(line) && line[i] != '=' && !isFieldSep(line[i]) {
+			i++
+		}
+		if i == start {
+			return Entry{}, fmt.Errorf("empty key at %d", i)
+		}
+		key := string(line[start:i])
+		if i == len(line) || line[i] != '=' {
+			return Entry{}, fmt.Errorf("key %q has no value", key)
+		}
+		i++
+
+		var (
+			val string
+			err error
+		)
+		if i < len(line) && line[i] == opts.QuoteChar {
+			start = i
+			for i++; i < len(line) && line[i] != opts.QuoteChar; i++ {
+				if line[i] == '\\' {
+					i++
+				}
+			}
+			if i >= len(line) {
+				return Entry{}, fmt.Errorf("unterminated value of %q", key)
+			}
+			if val, err = unquote(line[start+1:i], opts.QuoteChar); err != nil {
+				return Entry{}, fmt.Errorf("value of %q: %v", key, err)
+			}
+			i++
+		} else {
+			start = i
+			for i < len(line) && !isFieldSep(line[i]) {
+				i++
+			}
+			val = string(line[start:i])
+		}
+
+		if err := e.set(key, val, opts); err != nil {
+			return Entry{}, err
+		}
+	}
+
+	return e, nil
+}
+
+// set sets the field on the entry. Repeated keys among the special fields
+// are kept as regular fields.
+func (e *Entry) set(key, val string, opts Opts) error {
+	switch {
+	case key == tsKey && e.Timestamp.IsZero():
+		t, err := time.Parse(opts.TimestampFormat, val)
+		if err != nil {
+			return fmt.Errorf("invalid timestamp %q: %v", val, err)
+		}
+		e.Timestamp = t
+	case key == levelKey && e.Level == 0:
+		lvl, err := logf.LevelFromString(val)
+		if err != nil {
+			return fmt.Errorf("invalid level %q", val)
+		}
+		e.Level = lvl
+	case key == msgKey && e.Message == "":
+		e.Message = val
+	case key == scopeKey && e.Scope == "":
+		e.Scope = val
+	case key == callerKey && e.Caller == "":
+		e.Caller = val
+	default:
+		e.Fields = append(e.Fields, logf.KV{Key: key, Value: val})
+	}
+
+	return nil
+}
+
+// unquote reverses the escaping of quoted values by the logger: \\, \n,
+// \r, \t, the quote character and \uXXXX, with surrogate pairs.
+func unquote(b []byte, quote byte) (string, error) {
+	if bytes.IndexByte(b, '\\') == -1 {
+		return string(b), nil
+	}
+
+	out := make([]byte, 0, len(b))
+	for i := 0; i < len(b); i++ {
+		if b[i] != '\\' {
+			out = append(out, b[i])
+			continue
+		}
+
+		i++
+		if i == len(b) {
+			return "", fmt.Errorf("trailing backslash")
+		}
+		switch c := b[i]; c {
+		case '\\', quote:
+			out = append(out, c)
+		case 'n':
+			out = append(out, '\n')
+		case 'r':
+			out = append(out, '\r')
+		case 't':
+			out = append(out, '\t')
+		case 'u':
+			r, n, err := unquoteRune(b[i+1:])
+			if err != nil {
+				return "", err
+			}
+			var enc [utf8.UTFMax]byte
+			out = append(out, enc[:utf8.EncodeRune(enc[:], r)]...)
+			i += n
+		default:
+			return "", fmt.Errorf("invalid escape \\%c", c)
+		}
+	}
+
+	return string(out), nil
+}
+
+// unquoteRune decodes the XXXX of a \uXXXX escape, and the low half of a
+// surrogate pair following it. It returns the number of bytes read.
+func unquoteRune(b []byte) (rune, int, error) {
+	r, err := hexRune(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	if !utf16.IsSurrogate(r) {
+		return r, 4, nil
+	}
+
+	if len(b) < 10 || b[4] != '\\' || b[5] != 'u' {
+		return utf8.RuneError, 4, nil
+	}
+	lo, err := hexRune(b[6:])
+	if err != nil {
+		return 0, 0, err
+	}
+	return utf16.DecodeRune(r, lo), 10, nil
+}
+
+func hexRune(b []byte) (rune, error) {
+	if len(b) < 4 {
+		return 0, fmt.Errorf("invalid \\u escape")
+	}
+	n, err := strconv.ParseUint(string(b[:4]), 16, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid \\u escape %q", b[:4])
+	}
+	return rune(n), nil
+}
+
+func isFieldSep(c byte) bool {
+	return c == ' ' || c == '\t'
+}
@@ -0,0 +1,83 @@
+package logfparse
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zerodha/logf"
+)
+
+func TestScanner(t *testing.T) {
+	now := time.Date(2022, 7, 7, 12, 0, 0, 123e6, time.UTC)
+	buf := &bytes.Buffer{}
+	l := logf.New(logf.Opts{Writer: buf, Level: logf.DebugLevel, EnableCaller: true, Clock: func() time.Time { return now },
+		DefaultFields: []interface{}{"scope", "worker"}})
+
+	vals := []string{
+		"plain", "", "with space", `quo"te`, `back\slash`, "new\nline\r\ttab",
+		"a=b", "null", "\x01ctrl", "ünïcödé 🙂", "\xffbad",
+	}
+	// Log, unlike Debug, isn't compiled out with logf_nodebug.
+	for _, v := range vals {
+		l.Log(logf.DebugLevel, v, "val", v, "n", 42)
+	}
+	l.Error("done")
+
+	s := NewScanner(buf, Opts{})
+	for _, v := range vals {
+		require.True(t, s.Scan(), s.Err())
+		e := s.Entry()
+		require.Equal(t, now, e.Timestamp.UTC())
+		require.Equal(t, logf.DebugLevel, e.Level)
+		require.Equal(t, "worker", e.Scope)
+		require.Contains(t, e.Caller, "logfparse/scanner_test.go:")
+
+		want := strings.Replace(v, "\xff", "�", -1)
+		require.Equal(t, want, e.Message)
+		require.Equal(t, logf.OrderedFields{{Key: "val", Value: want}, {Key: "n", Value: "42"}}, e.Fields)
+	}
+	require.True(t, s.Scan())
+	require.Equal(t, logf.ErrorLevel, s.Entry().Level)
+	require.Equal(t, "done", s.Entry().Message)
+	require.False(t, s.Scan())
+	require.NoError(t, s.Err())
+}
+
+func TestScannerOpts(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := logf.New(logf.Opts{Writer: buf, QuoteChar: '\'', ASCIIOnly: true, TimestampFormat: time.RFC3339, LineEnding: "\r\n"})
+	l.Info("it's", "emoji", "🙂 ok")
+	buf.WriteString("\n")
+	l.Info("second")
+
+	s := NewScanner(buf, Opts{QuoteChar: '\'', TimestampFormat: time.RFC3339})
+	require.True(t, s.Scan(), s.Err())
+	require.Equal(t, "it's", s.Entry().Message)
+	require.Equal(t, logf.OrderedFields{{Key: "emoji", Value: "🙂 ok"}}, s.Entry().Fields)
+	require.False(t, s.Entry().Timestamp.IsZero())
+	require.True(t, s.Scan(), s.Err())
+	require.Equal(t, "second", s.Entry().Message)
+	require.False(t, s.Scan())
+	require.NoError(t, s.Err())
+}
+
+func TestScannerErrors(t *testing.T) {
+	for _, line := range []string{
+		`level=info message="unterminated`,
+		`level=info message`,
+		`level=info =empty`,
+		`level=loud`,
+		`timestamp=yesterday`,
+		`message="bad \q escape"`,
+		`message="\u12"`,
+	} {
+		s := NewScanner(strings.NewReader("level=info\n"+line+"\nlevel=info\n"), Opts{})
+		require.True(t, s.Scan(), line)
+		require.False(t, s.Scan(), line)
+		require.Contains(t, s.Err().Error(), "logfparse: line 2: ", line)
+		require.False(t, s.Scan(), line)
+	}
+}
@@ -0,0 +1,38 @@
+// Package logftrace adds trace and span IDs from a context to a
+// logf.Logger, to correlate logs with traces.
+//
+// It doesn't depend on a tracing library. The IDs are read with a
+// SpanContextFunc, which for OpenTelemetry is:
+//
+//	func(ctx context.Context) (string, string, bool) {
+//		sc := trace.SpanContextFromContext(ctx)
+//		return sc.TraceID().String(), sc.SpanID().String(), sc.IsValid()
+//	}
+package logftrace
+
+import (
+	"context"
+
+	"github.com/zerodha/logf"
+)
+
+const (
+	traceIDKey = "trace_id"
+	spanIDKey  = "span_id"
+)
+
+// SpanContextFunc returns the trace and span IDs of the active span in
+// ctx, and whether there's a valid one.
+type SpanContextFunc func(ctx context.Context) (traceID, spanID string, ok bool)
+
+// WithSpanContext returns a copy of l with trace_id and span_id fields
+// for the active span in ctx, read with fn. l is returned as is if there's
+// no valid span.
+func WithSpanContext(ctx context.Context, l logf.Logger, fn SpanContextFunc) logf.Logger {
+	traceID, spanID, ok := fn(ctx)
+	if !ok {
+		return l
+	}
+
+	return l.With(traceIDKey, traceID, spanIDKey, spanID)
+}
@@ -0,0 +1,46 @@
+package logftrace
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/zerodha/logf"
+)
+
+type spanKey struct{}
+
+type fakeSpan struct {
+	traceID, spanID string
+}
+
+func fakeSpanContext(ctx context.Context) (string, string, bool) {
+	s, ok := ctx.Value(spanKey{}).(fakeSpan)
+	if !ok || s.traceID == "" || s.spanID == "" {
+		return "", "", false
+	}
+	return s.traceID, s.spanID, true
+}
+
+func TestWithSpanContext(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := logf.New(logf.Opts{Writer: buf})
+
+	ctx := context.WithValue(context.Background(), spanKey{}, fakeSpan{
+		traceID: "4bf92f3577b34da6a3ce929d0e0e4736",
+		spanID:  "00f067aa0ba902b7",
+	})
+	WithSpanContext(ctx, l, fakeSpanContext).Info("hello")
+	require.Contains(t, buf.String(), `message=hello trace_id=4bf92f3577b34da6a3ce929d0e0e4736 span_id=00f067aa0ba902b7`+"\n")
+	buf.Reset()
+
+	// No span.
+	WithSpanContext(context.Background(), l, fakeSpanContext).Info("hello")
+	require.NotContains(t, buf.String(), "trace_id")
+
+	// Invalid span.
+	ctx = context.WithValue(context.Background(), spanKey{}, fakeSpan{traceID: "4bf92f3577b34da6a3ce929d0e0e4736"})
+	WithSpanContext(ctx, l, fakeSpanContext).Info("hello")
+	require.NotContains(t, buf.String(), "trace_id")
+}
@@ -0,0 +1,20 @@
+//go:build go1.20
+// +build go1.20
+
+package logf
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// errors.Join needs go1.20. See TestJoinedErrors for the rest.
+func TestErrorsJoin(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+	l.Error("request failed", "error", errors.Join(errors.New("dial failed"), errors.New("timeout")))
+	require.Contains(t, buf.String(), `message="request failed" error.0="dial failed" error.1=timeout`+"\n")
+}
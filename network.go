@@ -0,0 +1,286 @@
+package logf
+
+import (
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultNetworkBufferSize = 1 << 20
+	defaultDialTimeout       = 5 * time.Second
+	defaultWriteTimeout      = 5 * time.Second
+	defaultMinBackoff        = 100 * time.Millisecond
+	defaultMaxBackoff        = 30 * time.Second
+)
+
+// NetworkOpts represents the config options for NetworkWriter.
+type NetworkOpts struct {
+	// BufferSize is the maximum number of bytes of lines held while the
+	// connection is down. Defaults to 1MB.
+	BufferSize int
+
+	// Fallback, if set, is written the lines that don't fit in the buffer
+	// while the connection is down, eg: os.Stderr. They're dropped
+	// otherwise.
+	Fallback io.Writer
+
+	// DialTimeout is the timeout of every connection attempt. Defaults to
+	// 5s.
+	DialTimeout time.Duration
+
+	// WriteTimeout is the timeout of every write to the connection, after
+	// which a stalled collector is treated like a down one. Defaults to
+	// 5s.
+	WriteTimeout time.Duration
+
+	// MinBackoff is the wait after a failed connection attempt. It's
+	// doubled after every failure up to MaxBackoff and reset once
+	// connected. Defaults to 100ms and 30s.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// NetworkWriter is an io.Writer that writes lines to a TCP, UDP or unix
+// socket, eg: a log collector. Lines written while the connection is down
+// are buffered, up to NetworkOpts.BufferSize, and written out in order once
+// it's reconnected.
+//
+// Writes never block on a down connection beyond a connection attempt,
+// which is made on a Write or Flush at most once per backoff interval, or
+// on a stalled one beyond NetworkOpts.WriteTimeout. A connection closed by
+// the peer is noticed before the next write, so that the line is buffered
+// instead of being lost.
+// Lines that don't fit in the buffer go to NetworkOpts.Fallback or are
+// dropped, so a persistently unreachable address loses lines instead of
+// stalling the program. Every line is written to UDP sockets as a
+// separate datagram.
+type NetworkWriter struct {
+	mu      sync.Mutex
+	network string
+	addr    string
+	opts    NetworkOpts
+
+	conn     net.Conn
+	connDead *int32
+	backoff  time.Duration
+	nextDial time.Time
+
+	// Lines waiting for a connection and their total size.
+	pending [][]byte
+	size    int
+
+	dropped uint64
+	closed  bool
+}
+
+// NewNetworkWriter returns a NetworkWriter writing to addr on network, as
+// accepted by net.Dial. The connection is made on the first write.
+func NewNetworkWriter(network, addr string, opts NetworkOpts) *NetworkWriter {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = defaultNetworkBufferSize
+	}
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = defaultDialTimeout
+	}
+	if opts.WriteTimeout <= 0 {
+		opts.WriteTimeout = defaultWriteTimeout
+	}
+	if opts.MinBackoff <= 0 {
+		opts.MinBackoff = defaultMinBackoff
+	}
+	if opts.MaxBackoff < opts.MinBackoff {
+		opts.MaxBackoff = defaultMaxBackoff
+		if opts.MaxBackoff < opts.MinBackoff {
+			opts.MaxBackoff = opts.MinBackoff
+		}
+	}
+
+	return &NetworkWriter{
+		network: network,
+		addr:    addr,
+		opts:    opts,
+		backoff: opts.MinBackoff,
+	}
+}
+
+// Write writes p, or buffers it if the connection is down. It only
+// returns an error, ErrWriterClosed, after Close.
+func (w *NetworkWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return 0, ErrWriterClosed
+	}
+
+	// All of p is accounted for, sent or buffered, so the whole length
+	// is returned even after a partial write.
+	size := len(p)
+
+	// Write straight away if there's nothing waiting to go before p.
+	if len(w.pending) == 0 && w.connect() {
+		n, err := w.write(p)
+		if err == nil {
+			return size, nil
+		}
+		w.disconnect(err)
+
+		// Only buffer what wasn't sent.
+		p = p[n:]
+	}
+
+	w.buffer(p)
+	w.writePending()
+	return size, nil
+}
+
+// Flush tries to write out the buffered lines, reconnecting if the
+// backoff allows.
+func (w *NetworkWriter) Flush() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if !w.closed {
+		w.writePending()
+	}
+	return nil
+}
+
+// Dropped returns the number of lines dropped because they didn't fit in
+// the buffer and there's no Fallback.
+func (w *NetworkWriter) Dropped() uint64 {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.dropped
+}
+
+// Close tries to write out the buffered lines and closes the connection.
+// Lines still buffered are written to the Fallback, if set.
+func (w *NetworkWriter) Close() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+
+	w.writePending()
+	for _, b := range w.pending {
+		w.spill(b)
+	}
+	w.pending, w.size = nil, 0
+
+	if w.conn == nil {
+		return nil
+	}
+	err := w.conn.Close()
+	w.conn = nil
+	return err
+}
+
+// connect dials if there's no connection, or the peer closed it, and the
+// backoff since the last failed attempt has passed. It reports whether
+// there's a connection.
+func (w *NetworkWriter) connect() bool {
+	if w.conn != nil && atomic.LoadInt32(w.connDead) == 0 {
+		return true
+	}
+	if w.conn != nil {
+		w.disconnect(nil)
+	}
+
+	now := time.Now()
+	if now.Before(w.nextDial) {
+		return false
+	}
+
+	conn, err := net.DialTimeout(w.network, w.addr, w.opts.DialTimeout)
+	if err != nil {
+		w.nextDial = now.Add(w.backoff)
+		w.backoff *= 2
+		if w.backoff > w.opts.MaxBackoff {
+			w.backoff = w.opts.MaxBackoff
+		}
+		return false
+	}
+
+	w.conn = conn
+	w.connDead = new(int32)
+	w.backoff = w.opts.MinBackoff
+	go watchConn(conn, w.connDead)
+	return true
+}
+
+// watchConn sets dead once the peer closes conn, or it's closed, by
+// reading from it until it fails. Anything the peer sends is discarded.
+func watchConn(conn net.Conn, dead *int32) {
+	var b [512]byte
+	for {
+		if _, err := conn.Read(b[:]); err != nil {
+			atomic.StoreInt32(dead, 1)
+			return
+		}
+	}
+}
+
+// write writes p to the connection within the write timeout.
+func (w *NetworkWriter) write(p []byte) (int, error) {
+	w.conn.SetWriteDeadline(time.Now().Add(w.opts.WriteTimeout))
+	return w.conn.Write(p)
+}
+
+// disconnect closes a failed connection. The next attempt is made right
+// away, as the address was reachable until now, unless the write timed out
+// on a stalled collector.
+func (w *NetworkWriter) disconnect(err error) {
+	w.conn.Close()
+	w.conn = nil
+
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		w.nextDial = time.Now().Add(w.backoff)
+	}
+}
+
+// writePending writes the buffered lines in order, until one fails. What
+// was sent of a line that failed isn't sent again.
+func (w *NetworkWriter) writePending() {
+	for len(w.pending) > 0 && w.connect() {
+		b := w.pending[0]
+		if n, err := w.write(b); err != nil {
+			w.disconnect(err)
+			w.pending[0] = b[n:]
+			w.size -= n
+			return
+		}
+
+		w.pending[0] = nil
+		w.pending = w.pending[1:]
+		w.size -= len(b)
+	}
+}
+
+// buffer copies p to the pending lines if it fits, or spills it.
+func (w *NetworkWriter) buffer(p []byte) {
+	if w.size+len(p) > w.opts.BufferSize {
+		w.spill(p)
+		return
+	}
+
+	w.pending = append(w.pending, append([]byte(nil), p...))
+	w.size += len(p)
+}
+
+// spill writes a line that can't be sent to the Fallback, or drops it.
+func (w *NetworkWriter) spill(p []byte) {
+	if w.opts.Fallback == nil {
+		w.dropped++
+		return
+	}
+	if _, err := w.opts.Fallback.Write(p); err != nil {
+		w.dropped++
+	}
+}
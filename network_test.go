@@ -0,0 +1,199 @@
+package logf
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+// readLines reads n lines from the first connection accepted by ln.
+func readLines(t *testing.T, ln net.Listener, n int) []string {
+	t.Helper()
+
+	conn, err := ln.Accept()
+	require.NoError(t, err)
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	r := bufio.NewReader(conn)
+	lines := make([]string, 0, n)
+	for len(lines) < n {
+		s, err := r.ReadString('\n')
+		require.NoError(t, err)
+		lines = append(lines, strings.TrimSuffix(s, "\n"))
+	}
+	return lines
+}
+
+func TestNetworkWriter(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+
+	w := NewNetworkWriter("tcp", addr, NetworkOpts{MinBackoff: time.Millisecond, MaxBackoff: time.Millisecond})
+	defer w.Close()
+
+	l := New(Opts{Writer: w})
+	l.Info("one")
+	l.Info("two")
+	lines := readLines(t, ln, 2)
+	require.Contains(t, lines[0], "message=one")
+	require.Contains(t, lines[1], "message=two")
+
+	// Lines are buffered while the collector is down. readLines has
+	// closed the connection, which is noticed before the next write.
+	require.NoError(t, ln.Close())
+	require.Eventually(t, func() bool {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		return atomic.LoadInt32(w.connDead) == 1
+	}, 5*time.Second, time.Millisecond)
+	l.Info("three")
+	l.Info("four")
+	require.Len(t, w.pending, 2)
+
+	// And written in order once it's back.
+	ln, err = net.Listen("tcp", addr)
+	require.NoError(t, err)
+	defer ln.Close()
+
+	time.Sleep(5 * time.Millisecond)
+	l.Info("five")
+	lines = readLines(t, ln, 3)
+	require.Contains(t, lines[0], "message=three")
+	require.Contains(t, lines[1], "message=four")
+	require.Contains(t, lines[2], "message=five")
+	require.Zero(t, w.Dropped())
+
+	require.NoError(t, w.Close())
+	_, err = w.Write([]byte("six\n"))
+	require.ErrorIs(t, err, ErrWriterClosed)
+}
+
+func TestNetworkWriterFallback(t *testing.T) {
+	// Nothing listens on the address.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	addr := ln.Addr().String()
+	require.NoError(t, ln.Close())
+
+	fallback := &bytes.Buffer{}
+	w := NewNetworkWriter("tcp", addr, NetworkOpts{BufferSize: 8, Fallback: fallback, MinBackoff: time.Hour})
+	w.Write([]byte("line 1\n"))
+	w.Write([]byte("line 2\n"))
+	require.Equal(t, "line 2\n", fallback.String(), "lines that don't fit go to the fallback")
+
+	// Buffered lines go to the fallback on Close.
+	require.NoError(t, w.Close())
+	require.Equal(t, "line 2\nline 1\n", fallback.String())
+
+	w = NewNetworkWriter("tcp", addr, NetworkOpts{BufferSize: 8, MinBackoff: time.Hour})
+	w.Write([]byte("line 1\n"))
+	w.Write([]byte("line 2\n"))
+	require.Equal(t, uint64(1), w.Dropped())
+}
+
+func TestNetworkWriterStalled(t *testing.T) {
+	// The collector accepts the connection but never reads from it.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+	go func() {
+		conn, err := ln.Accept()
+		if err == nil {
+			defer conn.Close()
+			time.Sleep(10 * time.Second)
+		}
+	}()
+
+	w := NewNetworkWriter("tcp", ln.Addr().String(), NetworkOpts{BufferSize: 1, WriteTimeout: 50 * time.Millisecond, MinBackoff: time.Hour})
+	defer w.Close()
+
+	// Writes return once the socket buffers are full, instead of blocking.
+	line := bytes.Repeat([]byte("x"), 1<<20)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < 64; i++ {
+			w.Write(line)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("writes blocked on a stalled connection")
+	}
+	require.NotZero(t, w.Dropped())
+}
+
+// shortConn fails a write after writing part of it.
+type shortConn struct {
+	net.Conn
+	buf bytes.Buffer
+	max int
+}
+
+func (c *shortConn) Write(p []byte) (int, error) {
+	if len(p) > c.max {
+		c.buf.Write(p[:c.max])
+		return c.max, errors.New("connection reset")
+	}
+	return c.buf.Write(p)
+}
+
+func TestNetworkWriterPartialWrite(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	w := NewNetworkWriter("tcp", ln.Addr().String(), NetworkOpts{MinBackoff: time.Hour})
+	defer w.Close()
+	_, err = w.Write([]byte("first\n"))
+	require.NoError(t, err)
+
+	require.Equal(t, []string{"first"}, readLines(t, ln, 1))
+
+	// Only the unsent rest of the line is written after reconnecting.
+	c := &shortConn{Conn: w.conn, max: 4}
+	w.conn = c
+	n, err := w.Write([]byte("hello world\n"))
+	require.NoError(t, err)
+	require.Equal(t, 12, n)
+	require.Equal(t, "hell", c.buf.String())
+	require.Equal(t, []string{"o world"}, readLines(t, ln, 1))
+	require.Empty(t, w.pending)
+	require.Zero(t, w.size)
+}
+
+func TestNetworkWriterPartialWriteLogger(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer ln.Close()
+
+	w := NewNetworkWriter("tcp", ln.Addr().String(), NetworkOpts{MinBackoff: time.Hour})
+	defer w.Close()
+	require.True(t, w.connect())
+	first, err := ln.Accept()
+	require.NoError(t, err)
+	first.Close()
+	c := &shortConn{Conn: w.conn, max: 4}
+	w.conn = c
+
+	// The logger retries short writes, so the rest of the line would be
+	// sent twice if Write didn't report all of it written.
+	l := New(Opts{Writer: w, Clock: func() time.Time { return time.Date(2022, 7, 7, 0, 0, 0, 0, time.UTC) }})
+	l.Info("hello")
+	l.Info("world")
+	require.Equal(t, "time", c.buf.String())
+	require.Equal(t, []string{
+		"stamp=2022-07-07T00:00:00Z level=info message=hello",
+		"timestamp=2022-07-07T00:00:00Z level=info message=world",
+	}, readLines(t, ln, 2))
+}
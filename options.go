@@ -0,0 +1,77 @@
+package logf
+
+import "io"
+
+// Option configures the options of a logger created with NewWithOptions.
+// Options are named Opt*, so that they don't read like the With* methods
+// of Logger, which derive loggers.
+type Option func(*Opts)
+
+// NewWithOptions instantiates a logger writing to out, configured with opts.
+// It's equivalent to calling New with the corresponding Opts.
+func NewWithOptions(out io.Writer, opts ...Option) Logger {
+	o := Opts{Writer: out}
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	return New(o)
+}
+
+// OptLevel sets the minimum level of the logs emitted.
+func OptLevel(lvl Level) Option {
+	return func(o *Opts) {
+		o.Level = lvl
+	}
+}
+
+// OptColor enables or disables colored output.
+func OptColor(enable bool) Option {
+	return func(o *Opts) {
+		o.EnableColor = enable
+	}
+}
+
+// OptCaller enables or disables the caller field.
+func OptCaller(enable bool) Option {
+	return func(o *Opts) {
+		o.EnableCaller = enable
+	}
+}
+
+// OptScope adds a scope field to every log. An empty scope is omitted.
+func OptScope(scope string) Option {
+	return func(o *Opts) {
+		if scope != "" {
+			o.DefaultFields = append(o.DefaultFields, scopeKey, scope)
+		}
+	}
+}
+
+// OptVersion adds a version field to every log.
+func OptVersion(version string) Option {
+	return func(o *Opts) {
+		o.Version = version
+	}
+}
+
+// OptTimestampFormat sets the layout of the timestamp.
+func OptTimestampFormat(format string) Option {
+	return func(o *Opts) {
+		o.TimestampFormat = format
+	}
+}
+
+// OptFormat sets the format of the log lines.
+func OptFormat(f Format) Option {
+	return func(o *Opts) {
+		o.Format = f
+	}
+}
+
+// OptDefaultFields adds fields to every log.
+func OptDefaultFields(fields ...interface{}) Option {
+	return func(o *Opts) {
+		o.DefaultFields = append(o.DefaultFields, fields...)
+	}
+}
@@ -0,0 +1,44 @@
+package logf
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewWithOptions(t *testing.T) {
+	skipWithoutDebug(t)
+
+	buf := &bytes.Buffer{}
+
+	// Defaults are the same as New.
+	l := NewWithOptions(buf)
+	require.Equal(t, InfoLevel, l.Opts.Level)
+	require.Equal(t, defaultTSFormat, l.Opts.TimestampFormat)
+	require.False(t, l.Opts.EnableColor)
+	require.False(t, l.Opts.EnableCaller)
+
+	l = NewWithOptions(buf,
+		OptLevel(DebugLevel),
+		OptCaller(true),
+		OptScope("db"),
+		OptDefaultFields("service", "api"),
+		OptTimestampFormat("2006"),
+		OptVersion("v1"),
+	)
+	l.Debug("hello world", "key", "val")
+	require.Regexp(t, `^timestamp=\d{4} level=debug message="hello world" caller=\S+/options_test.go:\d+ version=v1 scope=db service=api key=val\n$`, buf.String())
+	buf.Reset()
+
+	l = NewWithOptions(buf, OptColor(true), OptFormat(FormatConsole))
+	require.True(t, l.Opts.EnableColor)
+	require.Equal(t, FormatConsole, l.Opts.Format)
+	require.Equal(t, consoleTSFormat, l.Opts.TimestampFormat)
+
+	// Later options win.
+	l = NewWithOptions(buf, OptLevel(ErrorLevel), OptLevel(WarnLevel), OptScope(""))
+	l.Warn("hello world")
+	require.Contains(t, buf.String(), `level=warn message="hello world"`)
+	require.NotContains(t, buf.String(), "scope=")
+}
@@ -0,0 +1,27 @@
+package logf
+
+import (
+	"os"
+	"sync"
+)
+
+var (
+	procOnce   sync.Once
+	procFields []interface{}
+
+	// Overridden in tests.
+	hostname = os.Hostname
+)
+
+// getProcessFields returns the host and pid fields, looking them up on
+// the first call. host is left out if the hostname can't be read.
+func getProcessFields() []interface{} {
+	procOnce.Do(func() {
+		if h, err := hostname(); err == nil {
+			procFields = append(procFields, "host", h)
+		}
+		procFields = append(procFields, "pid", os.Getpid())
+	})
+
+	return procFields
+}
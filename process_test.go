@@ -0,0 +1,43 @@
+package logf
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestProcessFields(t *testing.T) {
+	oldHostname := hostname
+	defer func() {
+		hostname = oldHostname
+		procOnce = sync.Once{}
+		procFields = nil
+	}()
+
+	var calls int
+	hostname = func() (string, error) {
+		calls++
+		return "web-1", nil
+	}
+	procOnce = sync.Once{}
+	procFields = nil
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, ProcessFields: true, DefaultFields: []interface{}{"app", "api"}})
+	l.Info("hello")
+	l.Info("world")
+	New(Opts{Writer: buf, ProcessFields: true}).Info("again")
+
+	require.Contains(t, buf.String(), fmt.Sprintf(`message=hello host=web-1 pid=%d app=api`+"\n", os.Getpid()))
+	require.Contains(t, buf.String(), fmt.Sprintf(`message=again host=web-1 pid=%d`+"\n", os.Getpid()))
+	require.Equal(t, 1, calls, "hostname is cached")
+
+	// Not added unless enabled.
+	buf.Reset()
+	New(Opts{Writer: buf}).Info("hello")
+	require.NotContains(t, buf.String(), "pid=")
+}
@@ -0,0 +1,74 @@
+package logf
+
+import (
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+const (
+	panicKey   = "panic"
+	stackKey   = "stack"
+	panicMsg   = "recovered panic"
+	stackDepth = 64
+)
+
+// RecoverAndLog recovers a panic, logs it at error level with the value
+// and the stack of the panic, flushes the writer and panics again with the
+// same value. It has to be deferred directly to recover, eg:
+//
+//	defer l.RecoverAndLog()
+func (l Logger) RecoverAndLog() {
+	if r := recover(); r != nil {
+		l.handleLog(panicMsg, ErrorLevel, panicKey, r, stackKey, panicStack())
+		l.flushOut()
+		panic(r)
+	}
+}
+
+// Recover is the same as RecoverAndLog, but doesn't panic again, eg: for
+// goroutines whose panics shouldn't crash the program.
+func (l Logger) Recover() {
+	if r := recover(); r != nil {
+		l.handleLog(panicMsg, ErrorLevel, panicKey, r, stackKey, panicStack())
+	}
+}
+
+// panicStack returns the stack of the panicking goroutine as
+// function\n\tfile:line lines, like runtime/debug.Stack, starting from the
+// frame that panicked. The frames of the recovery and the runtime's panic
+// handling are skipped.
+func panicStack() string {
+	// Skip runtime.Callers, panicStack and RecoverAndLog/Recover.
+	pcs := make([]uintptr, stackDepth)
+	frames := runtime.CallersFrames(pcs[:runtime.Callers(3, pcs)])
+
+	var (
+		b       strings.Builder
+		leading = true
+	)
+	for more := true; more; {
+		var f runtime.Frame
+		f, more = frames.Next()
+
+		// runtime.gopanic and the likes of runtime.sigpanic.
+		if leading && strings.HasPrefix(f.Function, "runtime.") {
+			continue
+		}
+		leading = false
+		if f.Function == "runtime.goexit" {
+			continue
+		}
+
+		if b.Len() > 0 {
+			b.WriteByte('\n')
+		}
+		b.WriteString(f.Function)
+		b.WriteString("\n\t")
+		b.WriteString(f.File)
+		b.WriteByte(':')
+		b.WriteString(strconv.Itoa(f.Line))
+	}
+
+	return b.String()
+}
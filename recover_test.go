@@ -0,0 +1,53 @@
+package logf
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func panickingFunc() {
+	var m map[string]int
+	m["key"] = 1
+}
+
+func TestRecover(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Format: FormatJSON})
+
+	require.NotPanics(t, func() {
+		defer l.Recover()
+		panickingFunc()
+	})
+
+	var out map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &out))
+	require.Equal(t, "error", out["level"])
+	require.Equal(t, "assignment to entry in nil map", out["panic"])
+
+	// The stack starts at the frame that panicked.
+	stack := out["stack"].(string)
+	require.Regexp(t, `^github.com/zerodha/logf.panickingFunc\n\t\S+/recover_test.go:\d+\n`, stack)
+	require.Contains(t, stack, "logf.TestRecover")
+	require.NotContains(t, stack, "runtime.")
+}
+
+func TestRecoverAndLog(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+
+	require.PanicsWithValue(t, "boom", func() {
+		defer l.RecoverAndLog()
+		panic("boom")
+	})
+	require.Contains(t, buf.String(), `level=error message="recovered panic" panic=boom stack="github.com/zerodha/logf.TestRecoverAndLog.func1\n\t`)
+
+	// Nothing is logged without a panic.
+	buf.Reset()
+	func() {
+		defer l.RecoverAndLog()
+	}()
+	require.Empty(t, buf.String())
+}
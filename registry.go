@@ -0,0 +1,53 @@
+package logf
+
+import "sync"
+
+var (
+	// registryMu guards defaultLogger and named.
+	registryMu    sync.RWMutex
+	defaultLogger = New(Opts{})
+	named         = map[string]Logger{}
+)
+
+// SetDefault sets the logger that Named derives loggers from. Loggers
+// returned by Named before are left as is, but are no longer returned.
+func SetDefault(l Logger) {
+	registryMu.Lock()
+	defaultLogger = l
+	named = map[string]Logger{}
+	registryMu.Unlock()
+}
+
+// Default returns the logger set with SetDefault. It writes to stderr
+// with the default options if SetDefault hasn't been called.
+func Default() Logger {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+
+	return defaultLogger
+}
+
+// Named returns a copy of the default logger with a scope=name field. The
+// logger is created on the first call for a name and the same one is
+// returned after, so that it can be fetched from anywhere in an app. It's
+// safe for concurrent use.
+func Named(name string) Logger {
+	registryMu.RLock()
+	l, ok := named[name]
+	registryMu.RUnlock()
+	if ok {
+		return l
+	}
+
+	registryMu.Lock()
+	defer registryMu.Unlock()
+
+	// Another goroutine may have created it in the meantime.
+	if l, ok := named[name]; ok {
+		return l
+	}
+	l = defaultLogger.With(scopeKey, name)
+	named[name] = l
+
+	return l
+}
@@ -0,0 +1,46 @@
+package logf
+
+import (
+	"bytes"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNamed(t *testing.T) {
+	old := Default()
+	defer SetDefault(old)
+
+	buf := &bytes.Buffer{}
+	SetDefault(New(Opts{Writer: buf, DefaultFields: []interface{}{"app", "api"}}))
+
+	db := Named("db")
+	db.Info("hello world")
+	require.Contains(t, buf.String(), `message="hello world" app=api scope=db`+"\n")
+	buf.Reset()
+
+	// The same logger is returned for a name.
+	require.Equal(t, db.DefaultFields, Named("db").DefaultFields)
+	require.Same(t, db.lvl, Named("db").lvl)
+	db.SetLevelAtomic(ErrorLevel)
+	Named("db").Info("hidden")
+	require.Empty(t, buf.String())
+
+	// SetDefault applies to later lookups.
+	SetDefault(New(Opts{Writer: buf, Format: FormatJSON}))
+	Named("db").Info("hello world")
+	require.Contains(t, buf.String(), `"message":"hello world","scope":"db"}`)
+
+	// Concurrent lookups.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			Named("cache")
+		}()
+	}
+	wg.Wait()
+	require.Same(t, Named("cache").lvl, Named("cache").lvl)
+}
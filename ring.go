@@ -0,0 +1,79 @@
+package logf
+
+import (
+	"io"
+	"sync"
+)
+
+// RingBuffer is an io.Writer that keeps the most recent lines in memory,
+// bounded by both number of lines and total bytes, to be dumped on a
+// crash for post-mortem debugging. It only sees the lines written to it,
+// so to retain lines below a logger's level, write to it from a separate
+// logger with a lower level.
+type RingBuffer struct {
+	mu       sync.Mutex
+	lines    [][]byte
+	start    int
+	n        int
+	size     int
+	maxBytes int
+}
+
+// NewRingBuffer returns a RingBuffer that retains up to capacity lines
+// and up to maxBytes bytes in total. A maxBytes of 0 means no byte limit.
+func NewRingBuffer(capacity, maxBytes int) *RingBuffer {
+	if capacity <= 0 {
+		capacity = 1
+	}
+
+	return &RingBuffer{
+		lines:    make([][]byte, capacity),
+		maxBytes: maxBytes,
+	}
+}
+
+// Write retains a copy of p, evicting the oldest lines to stay within the
+// limits. A line larger than maxBytes is discarded.
+func (r *RingBuffer) Write(p []byte) (int, error) {
+	if r.maxBytes > 0 && len(p) > r.maxBytes {
+		return len(p), nil
+	}
+
+	b := make([]byte, len(p))
+	copy(b, p)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for r.n == len(r.lines) || (r.maxBytes > 0 && r.size+len(b) > r.maxBytes) {
+		r.evict()
+	}
+
+	r.lines[(r.start+r.n)%len(r.lines)] = b
+	r.n++
+	r.size += len(b)
+
+	return len(p), nil
+}
+
+// evict removes the oldest line.
+func (r *RingBuffer) evict() {
+	r.size -= len(r.lines[r.start])
+	r.lines[r.start] = nil
+	r.start = (r.start + 1) % len(r.lines)
+	r.n--
+}
+
+// Dump writes the retained lines to w, oldest first.
+func (r *RingBuffer) Dump(w io.Writer) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	for i := 0; i < r.n; i++ {
+		if _, err := w.Write(r.lines[(r.start+i)%len(r.lines)]); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package logf
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRingBuffer(t *testing.T) {
+	r := NewRingBuffer(3, 0)
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(r, "line %d\n", i)
+	}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, r.Dump(buf))
+	require.Equal(t, "line 2\nline 3\nline 4\n", buf.String())
+}
+
+func TestRingBufferMaxBytes(t *testing.T) {
+	r := NewRingBuffer(10, 14)
+	for i := 0; i < 5; i++ {
+		fmt.Fprintf(r, "line %d\n", i)
+	}
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, r.Dump(buf))
+	require.Equal(t, "line 3\nline 4\n", buf.String())
+
+	// Lines larger than the limit are discarded.
+	fmt.Fprint(r, strings.Repeat("a", 15))
+	buf.Reset()
+	require.NoError(t, r.Dump(buf))
+	require.Equal(t, "line 3\nline 4\n", buf.String())
+}
+
+func TestRingBufferWithLogger(t *testing.T) {
+	skipWithoutDebug(t)
+
+	r := NewRingBuffer(100, 1<<20)
+	out := &bytes.Buffer{}
+
+	// Retain debug lines in the ring while only emitting errors.
+	debug := New(Opts{Writer: r, Level: DebugLevel})
+	l := New(Opts{Writer: io.MultiWriter(out, r), Level: ErrorLevel})
+
+	debug.Debug("debugging")
+	l.Info("filtered")
+	l.Error("failed")
+
+	require.NotContains(t, out.String(), "debugging")
+	buf := &bytes.Buffer{}
+	require.NoError(t, r.Dump(buf))
+	require.Contains(t, buf.String(), "message=debugging")
+	require.Contains(t, buf.String(), "message=failed")
+	require.NotContains(t, buf.String(), "message=filtered")
+}
+
+func TestRingBufferConcurrency(t *testing.T) {
+	r := NewRingBuffer(50, 1<<10)
+	l := New(Opts{Writer: r})
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			genLogs(l)
+			require.NoError(t, r.Dump(io.Discard))
+		}()
+	}
+	wg.Wait()
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, r.Dump(buf))
+	require.LessOrEqual(t, buf.Len(), 1<<10)
+}
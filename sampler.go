@@ -0,0 +1,120 @@
+package logf
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	sampledKey     = "sampled.dropped"
+	samplerBuckets = 4096
+)
+
+// SamplingOpts represents the config options for sampling repeated log lines.
+type SamplingOpts struct {
+	// Interval over which lines are sampled. Sampling is disabled if unset.
+	Interval time.Duration
+
+	// Number of lines with the same level and message emitted per
+	// interval. The rest are dropped. Defaults to 1.
+	First int
+}
+
+// sampler counts lines by level and message, and decides which ones
+// to drop. Counts are kept in a fixed number of buckets so that memory
+// doesn't grow with the number of distinct messages. A message evicts
+// a different one hashing to the same bucket.
+type sampler struct {
+	mu      sync.Mutex
+	opts    SamplingOpts
+	now     func() time.Time
+	buckets [samplerBuckets]sampleCount
+}
+
+// sampleCount holds the counts for one level and message in an interval.
+type sampleCount struct {
+	lvl     Level
+	msg     string
+	start   time.Time
+	n       int
+	dropped int
+}
+
+func newSampler(opts SamplingOpts) *sampler {
+	if opts.First <= 0 {
+		opts.First = 1
+	}
+
+	return &sampler{opts: opts, now: time.Now}
+}
+
+// sample returns false if the line should be dropped. When the first line
+// of a new interval is emitted, it also returns the number of lines that
+// were dropped in the previous interval.
+func (s *sampler) sample(lvl Level, msg string) (bool, int) {
+	idx := (hashString(msg) ^ uint32(lvl)) % samplerBuckets
+	now := s.now()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	c := &s.buckets[idx]
+	if c.lvl != lvl || c.msg != msg || now.Sub(c.start) >= s.opts.Interval {
+		dropped := 0
+		if c.lvl == lvl && c.msg == msg {
+			dropped = c.dropped
+		}
+		*c = sampleCount{lvl: lvl, msg: msg, start: now, n: 1}
+		return true, dropped
+	}
+
+	if c.n < s.opts.First {
+		c.n++
+		return true, 0
+	}
+
+	c.dropped++
+	return false, 0
+}
+
+// levelSampler emits 1 in N lines per level. It's shared by copies of
+// a Logger, so the counts are kept across With() etc.
+type levelSampler struct {
+	every [FatalLevel + 1]uint64
+	n     [FatalLevel + 1]uint64
+}
+
+// newLevelSampler returns nil if no level is sampled.
+func newLevelSampler(rates map[Level]int) *levelSampler {
+	var s *levelSampler
+	for lvl, n := range rates {
+		if n <= 1 || lvl < DebugLevel || lvl >= FatalLevel {
+			continue
+		}
+		if s == nil {
+			s = &levelSampler{}
+		}
+		s.every[lvl] = uint64(n)
+	}
+	return s
+}
+
+// sample returns false if the line should be dropped. The first line of
+// a level is always emitted.
+func (s *levelSampler) sample(lvl Level) bool {
+	if lvl < DebugLevel || lvl > FatalLevel || s.every[lvl] == 0 {
+		return true
+	}
+	return (atomic.AddUint64(&s.n[lvl], 1)-1)%s.every[lvl] == 0
+}
+
+// hashString returns the 32-bit FNV-1a hash of s without allocating.
+func hashString(s string) uint32 {
+	h := uint32(2166136261)
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= 16777619
+	}
+	return h
+}
@@ -0,0 +1,102 @@
+package logf
+
+import (
+	"bytes"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestSampling(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Sampling: SamplingOpts{Interval: time.Second, First: 2}})
+
+	now := time.Now()
+	l.sampler.now = func() time.Time { return now }
+
+	// A burst of 10 only emits the first 2.
+	for i := 0; i < 10; i++ {
+		l.Info("burst")
+	}
+	require.Equal(t, 2, strings.Count(buf.String(), "message=burst"))
+	require.NotContains(t, buf.String(), sampledKey)
+	buf.Reset()
+
+	// Other messages and levels are counted separately.
+	l.Warn("burst")
+	l.Info("other")
+	require.Equal(t, 2, strings.Count(buf.String(), "\n"))
+	require.NotContains(t, buf.String(), sampledKey)
+	buf.Reset()
+
+	// The first line of the next interval reports the drops.
+	now = now.Add(time.Second)
+	l.Info("burst", "key", "val")
+	require.Contains(t, buf.String(), "level=info message=burst key=val sampled.dropped=8\n")
+	buf.Reset()
+
+	// Another burst in the same interval.
+	for i := 0; i < 4; i++ {
+		l.Info("burst")
+	}
+	require.Equal(t, 1, strings.Count(buf.String(), "message=burst"))
+	buf.Reset()
+
+	now = now.Add(time.Second)
+	l.Info("burst")
+	require.Contains(t, buf.String(), "sampled.dropped=3\n")
+	buf.Reset()
+
+	// No drops in the previous interval, no field.
+	now = now.Add(time.Second)
+	l.Info("burst")
+	require.NotContains(t, buf.String(), sampledKey)
+}
+
+func TestSamplingDisabled(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+	require.Nil(t, l.sampler)
+
+	for i := 0; i < 10; i++ {
+		l.Info("burst")
+	}
+	require.Equal(t, 10, strings.Count(buf.String(), "message=burst"))
+}
+
+func TestLevelSampling(t *testing.T) {
+	skipWithoutDebug(t)
+
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Level: DebugLevel, LevelSampling: map[Level]int{DebugLevel: 10, InfoLevel: 1}})
+
+	for i := 0; i < 1000; i++ {
+		l.Debug("debug")
+		l.Info("info")
+		l.Error("error")
+	}
+	require.Equal(t, 100, strings.Count(buf.String(), "message=debug"))
+	require.Equal(t, 1000, strings.Count(buf.String(), "message=info"))
+	require.Equal(t, 1000, strings.Count(buf.String(), "message=error"))
+	buf.Reset()
+
+	// Copies share the counts, including across goroutines.
+	l = New(Opts{Writer: buf, Level: DebugLevel, LevelSampling: map[Level]int{DebugLevel: 4}})
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(c Logger) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				c.Debug("debug")
+			}
+		}(l.With("id", i))
+	}
+	wg.Wait()
+	require.Equal(t, 200, strings.Count(buf.String(), "message=debug"))
+
+	require.Nil(t, newLevelSampler(map[Level]int{InfoLevel: 1, FatalLevel: 2}))
+}
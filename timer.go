@@ -0,0 +1,32 @@
+package logf
+
+import "time"
+
+const tookKey = "took"
+
+// Timer measures the time taken by an operation and logs it.
+type Timer struct {
+	l     Logger
+	start time.Time
+}
+
+// Timer returns a Timer started at the current time, from Opts.Clock if
+// it's set.
+func (l Logger) Timer() Timer {
+	return Timer{l: l, start: l.now()}
+}
+
+// Elapsed returns the time passed since the timer was started.
+func (t Timer) Elapsed() time.Duration {
+	return t.l.now().Sub(t.start)
+}
+
+// Stop emits an info log line with the time passed since the timer was
+// started as the took field, after the given fields.
+func (t Timer) Stop(msg string, fields ...interface{}) {
+	f := make([]interface{}, 0, len(fields)+3)
+	f = appendFields(f, fields)
+	f = append(f, tookKey, t.Elapsed())
+
+	t.l.handleLog(msg, InfoLevel, f...)
+}
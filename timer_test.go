@@ -0,0 +1,34 @@
+package logf
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimer(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, EnableCaller: true})
+
+	timer := l.Timer()
+	time.Sleep(10 * time.Millisecond)
+	require.GreaterOrEqual(t, timer.Elapsed(), 10*time.Millisecond)
+
+	timer.Stop("done", "component", "db", "odd")
+	require.Regexp(t, `level=info message=done caller=\S+/timer_test.go:\d+ component=db !BADKEY=odd took=\d+(\.\d+)?ms\n$`, buf.String())
+}
+
+func TestTimerClock(t *testing.T) {
+	now := time.Date(2022, 7, 7, 12, 0, 0, 0, time.UTC)
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf, Clock: func() time.Time { return now }})
+
+	timer := l.Timer()
+	now = now.Add(1500 * time.Millisecond)
+	require.Equal(t, 1500*time.Millisecond, timer.Elapsed())
+
+	timer.Stop("done")
+	require.Equal(t, "timestamp=2022-07-07T12:00:01.5Z level=info message=done took=1.5s\n", buf.String())
+}
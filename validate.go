@@ -0,0 +1,133 @@
+package logf
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Validate serializes a log line like Encode, without writing it, and
+// checks that it's well formed: valid JSON, or logfmt without empty,
+// quoted or otherwise malformed keys, and no key written twice. It's
+// meant for tests and tooling that check log calls. Lines in the console
+// format or encoded with an Encoder can't be validated.
+func (l Logger) Validate(lvl Level, msg string, fields ...interface{}) error {
+	if l.Opts.Encoder != nil || l.Opts.Format == FormatConsole {
+		return errors.New("logf: only logfmt and JSON lines can be validated")
+	}
+
+	line := l.Encode(lvl, msg, fields...)
+	if !bytes.HasSuffix(line, []byte(l.Opts.LineEnding)) {
+		return errors.New("logf: line doesn't end with the line ending")
+	}
+	line = line[:len(line)-len(l.Opts.LineEnding)]
+
+	if l.Opts.Format == FormatJSON {
+		return validateJSON(line)
+	}
+
+	line = appendStripped(nil, line)
+	if l.Opts.BareTimestamp {
+		// Skip the timestamp, which has no key.
+		i := bytes.IndexAny(line, " \t")
+		if i == -1 {
+			return nil
+		}
+		line = line[i:]
+	}
+	return validateLogfmt(line, l.Opts.QuoteChar)
+}
+
+// validateJSON checks that line is a JSON object without duplicate keys.
+func validateJSON(line []byte) error {
+	if !json.Valid(line) {
+		return errors.New("logf: invalid JSON")
+	}
+
+	dec := json.NewDecoder(bytes.NewReader(line))
+	if t, err := dec.Token(); err != nil || t != json.Delim('{') {
+		return errors.New("logf: line isn't a JSON object")
+	}
+
+	seen := map[string]bool{}
+	for dec.More() {
+		t, err := dec.Token()
+		if err != nil {
+			return fmt.Errorf("logf: invalid JSON: %v", err)
+		}
+		key := t.(string)
+		if seen[key] {
+			return fmt.Errorf("logf: duplicate key %q", key)
+		}
+		seen[key] = true
+
+		var v json.RawMessage
+		if err := dec.Decode(&v); err != nil {
+			return fmt.Errorf("logf: invalid JSON: %v", err)
+		}
+	}
+
+	return nil
+}
+
+// validateLogfmt checks that line is a list of key=value pairs separated
+// by spaces or tabs, with unquoted keys, values quoted with quote if they
+// need to be, and no duplicate keys.
+func validateLogfmt(line []byte, quote byte) error {
+	seen := map[string]bool{}
+	for i := 0; i < len(line); {
+		if isFieldSep(line[i]) {
+			i++
+			continue
+		}
+
+		start := i
+		for ; i < len(line) && line[i] != '=' && !isFieldSep(line[i]); i++ {
+			if c := line[i]; c == '"' || c == quote || c < 0x20 {
+				return fmt.Errorf("logf: invalid character %q in key at %d", c, i)
+			}
+		}
+		if i == start {
+			return fmt.Errorf("logf: empty key at %d", i)
+		}
+		key := string(line[start:i])
+		if i == len(line) || line[i] != '=' {
+			return fmt.Errorf("logf: key %q has no value", key)
+		}
+		if seen[key] {
+			return fmt.Errorf("logf: duplicate key %q", key)
+		}
+		seen[key] = true
+		i++
+
+		if i < len(line) && line[i] == quote {
+			for i++; i < len(line) && line[i] != quote; i++ {
+				if line[i] == '\\' {
+					i++
+				} else if line[i] < 0x20 {
+					return fmt.Errorf("logf: invalid character %q in the value of %q", line[i], key)
+				}
+			}
+			if i >= len(line) {
+				return fmt.Errorf("logf: unterminated value of %q", key)
+			}
+			if i++; i < len(line) && !isFieldSep(line[i]) {
+				return fmt.Errorf("logf: unexpected character %q after the value of %q", line[i], key)
+			}
+			continue
+		}
+
+		for ; i < len(line) && !isFieldSep(line[i]); i++ {
+			if c := line[i]; c == '=' || c == '"' || c == quote || c < 0x20 {
+				return fmt.Errorf("logf: invalid character %q in the value of %q", c, key)
+			}
+		}
+	}
+
+	return nil
+}
+
+func isFieldSep(c byte) bool {
+	return c == ' ' || c == '\t'
+}
@@ -0,0 +1,45 @@
+package logf
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestValidate(t *testing.T) {
+	for _, opts := range []Opts{
+		{},
+		{EnableColor: true, FieldSeparator: "\t"},
+		{QuoteChar: '\''},
+		{Format: FormatJSON},
+		{BareTimestamp: true},
+	} {
+		buf := &bytes.Buffer{}
+		opts.Writer = buf
+		opts.EnableCaller = true
+		l := New(opts).With("app", "api")
+
+		require.NoError(t, l.Validate(InfoLevel, "hello world", "id", 1, "query", `SELECT "a" = 'b'`, "err", nil, "odd"))
+		require.NoError(t, l.Validate(ErrorLevel, "", "msg", "multi\nline"))
+		require.Empty(t, buf.String(), "nothing is written")
+
+		// The same key as one of the logger's fields. Fields repeated in
+		// the call are deduplicated.
+		require.EqualError(t, l.Validate(InfoLevel, "hello", "message", "again"), `logf: duplicate key "message"`)
+		require.NoError(t, l.Validate(InfoLevel, "hello", "id", 1, "id", 2))
+
+		if opts.Format == FormatJSON {
+			// Any string is a valid JSON key.
+			require.NoError(t, l.Validate(InfoLevel, "hello", "a key", 1, "", 2))
+			continue
+		}
+		require.ErrorContains(t, l.Validate(InfoLevel, "hello", "", 1), "logf: empty key")
+		require.ErrorContains(t, l.Validate(InfoLevel, "hello", "a key", 1), "logf: invalid character")
+		require.ErrorContains(t, l.Validate(InfoLevel, "hello", "k=v", 1), "logf: invalid character")
+		require.ErrorContains(t, l.Validate(InfoLevel, "hello", "line\nbreak", 1), "logf: invalid character")
+	}
+
+	l := New(Opts{Writer: &bytes.Buffer{}, Format: FormatConsole})
+	require.Error(t, l.Validate(InfoLevel, "hello"))
+}
@@ -0,0 +1,158 @@
+package logf
+
+import (
+	"bytes"
+	"io"
+	"strings"
+)
+
+// prefixWriter is an io.Writer that prepends a static prefix to every write.
+type prefixWriter struct {
+	prefix []byte
+	w      io.Writer
+}
+
+// PrefixWriter returns an io.Writer that prepends prefix to every write
+// before passing it on to w. It assumes that every Write is a complete
+// log line, which is what Logger guarantees.
+func PrefixWriter(prefix []byte, w io.Writer) io.Writer {
+	return &prefixWriter{prefix: prefix, w: w}
+}
+
+// Write writes the prefix and p to the underlying writer in a single Write.
+func (pw *prefixWriter) Write(p []byte) (int, error) {
+	buf := bufPool.Get()
+	buf.AppendBytes(pw.prefix)
+	buf.AppendBytes(p)
+
+	n, err := pw.w.Write(buf.Bytes())
+	bufPool.Put(buf)
+
+	// Don't report the prefix as written bytes of p.
+	n -= len(pw.prefix)
+	if n < 0 {
+		n = 0
+	}
+
+	return n, err
+}
+
+// stripColorWriter is an io.Writer that removes ANSI escape sequences.
+type stripColorWriter struct {
+	w io.Writer
+}
+
+// StripColorWriter returns an io.Writer that removes ANSI CSI escape
+// sequences, like the \033[..m color codes written with EnableColor, from
+// every write before passing it on to w. This lets a colored logger also
+// write plain text to a file, eg: with io.MultiWriter.
+func StripColorWriter(w io.Writer) io.Writer {
+	return &stripColorWriter{w: w}
+}
+
+// Write writes p without escape sequences to the underlying writer. It
+// reports all of p as written on success.
+func (sw *stripColorWriter) Write(p []byte) (int, error) {
+	if bytes.IndexByte(p, '\x1b') == -1 {
+		return sw.w.Write(p)
+	}
+
+	buf := bufPool.Get()
+	buf.B = appendStripped(buf.B, p)
+
+	_, err := sw.w.Write(buf.Bytes())
+	bufPool.Put(buf)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(p), nil
+}
+
+// appendStripped appends p without ANSI CSI escape sequences to dst.
+func appendStripped(dst, p []byte) []byte {
+	for i := 0; i < len(p); i++ {
+		if p[i] != '\x1b' || i+1 >= len(p) || p[i+1] != '[' {
+			dst = append(dst, p[i])
+			continue
+		}
+
+		// Skip the parameters up to and including the final byte.
+		j := i + 2
+		for j < len(p) && (p[j] < 0x40 || p[j] > 0x7e) {
+			j++
+		}
+		i = j
+	}
+
+	return dst
+}
+
+// StdlibOpts represents the config options for StdlibWriter.
+type StdlibOpts struct {
+	// Level the lines are logged at. Defaults to InfoLevel.
+	Level Level
+
+	// ParseCaller reads the file:line written by a standard library
+	// logger with the log.Lshortfile or log.Llongfile flag and writes it
+	// as the caller field, instead of the adapter's own call site. Any
+	// date and time before it is dropped, as the line gets the logger's
+	// own timestamp.
+	ParseCaller bool
+}
+
+// stdlibWriter is an io.Writer that logs every write as a line.
+type stdlibWriter struct {
+	l    Logger
+	opts StdlibOpts
+}
+
+// StdlibWriter returns an io.Writer that logs every write to l, to bridge
+// a standard library logger, eg: log.New(logf.StdlibWriter(l, opts), "", 0).
+// The line, without its trailing newline, is the message.
+func StdlibWriter(l Logger, opts StdlibOpts) io.Writer {
+	if opts.Level == 0 {
+		opts.Level = InfoLevel
+	}
+	return &stdlibWriter{l: l, opts: opts}
+}
+
+// Write logs p. It always reports all of p as written.
+func (sw *stdlibWriter) Write(p []byte) (int, error) {
+	msg := string(bytes.TrimRight(p, "\r\n"))
+
+	if sw.opts.ParseCaller {
+		if caller, rest, ok := stdlibCaller(msg); ok {
+			sw.l.WithCaller(caller).Log(sw.opts.Level, rest)
+			return len(p), nil
+		}
+	}
+
+	sw.l.Log(sw.opts.Level, msg)
+	return len(p), nil
+}
+
+// stdlibCaller splits a line written with log.Lshortfile or log.Llongfile,
+// eg: "2009/01/23 01:23:23 file.go:23: message", into the file:line and
+// the message.
+func stdlibCaller(line string) (string, string, bool) {
+	i := strings.Index(line, ": ")
+	if i == -1 {
+		return "", "", false
+	}
+
+	// The file:line is the last space separated token before ": ", with
+	// a file name that has an extension.
+	caller := line[strings.LastIndexByte(line[:i], ' ')+1 : i]
+	c := strings.LastIndexByte(caller, ':')
+	if c <= 0 || c == len(caller)-1 || !strings.Contains(caller[:c], ".") {
+		return "", "", false
+	}
+	for _, r := range caller[c+1:] {
+		if r < '0' || r > '9' {
+			return "", "", false
+		}
+	}
+
+	return caller, line[i+2:], true
+}
@@ -0,0 +1,95 @@
+package logf
+
+import (
+	"bytes"
+	"io"
+	"log"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrefixWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: PrefixWriter([]byte("<14>1 app: "), buf)})
+
+	l.Info("hello world")
+	l.Info("second line", "key", "val")
+
+	lines := bytes.Split(bytes.TrimSuffix(buf.Bytes(), []byte("\n")), []byte("\n"))
+	require.Len(t, lines, 2)
+	require.Regexp(t, `^<14>1 app: timestamp=\S+ level=info message="hello world"$`, string(lines[0]))
+	require.Regexp(t, `^<14>1 app: timestamp=\S+ level=info message="second line" key=val$`, string(lines[1]))
+}
+
+func TestPrefixWriterReturnsLength(t *testing.T) {
+	buf := &bytes.Buffer{}
+	w := PrefixWriter([]byte("prefix "), buf)
+
+	n, err := w.Write([]byte("line\n"))
+	require.NoError(t, err)
+	require.Equal(t, 5, n, "written count should exclude the prefix")
+	require.Equal(t, "prefix line\n", buf.String())
+
+	// Failed writes report an error.
+	w = PrefixWriter([]byte("prefix "), &errWriter{})
+	n, err = w.Write([]byte("line\n"))
+	require.Error(t, err)
+	require.Equal(t, 0, n)
+}
+
+func TestStripColorWriter(t *testing.T) {
+	colored, plain := &bytes.Buffer{}, &bytes.Buffer{}
+	l := New(Opts{Writer: io.MultiWriter(colored, StripColorWriter(plain)), EnableColor: true, DefaultFields: []interface{}{"service", "api"}})
+
+	l.Error("hello world", "key", "val")
+	require.Contains(t, colored.String(), "\x1b[31m")
+	require.NotContains(t, plain.String(), "\x1b")
+	require.Regexp(t, `^timestamp=\S+ level=error message="hello world" service=api key=val\n$`, plain.String())
+
+	// Lines without escape sequences are passed on as is.
+	plain.Reset()
+	w := StripColorWriter(plain)
+	n, err := w.Write([]byte("plain line\n"))
+	require.NoError(t, err)
+	require.Equal(t, 11, n)
+	require.Equal(t, "plain line\n", plain.String())
+
+	// Other CSI sequences and a trailing escape.
+	plain.Reset()
+	n, err = w.Write([]byte("\x1b[1;32mbold\x1b[0m \x1b[2Kcleared\x1b"))
+	require.NoError(t, err)
+	require.Equal(t, 28, n)
+	require.Equal(t, "bold cleared\x1b", plain.String())
+
+	_, err = StripColorWriter(&errWriter{}).Write([]byte("\x1b[31mline\n"))
+	require.Error(t, err)
+}
+
+func TestStdlibWriter(t *testing.T) {
+	buf := &bytes.Buffer{}
+	l := New(Opts{Writer: buf})
+
+	std := log.New(StdlibWriter(l, StdlibOpts{Level: WarnLevel, ParseCaller: true}), "", log.Lshortfile)
+	std.Printf("disk: %d%% full", 90)
+	require.Regexp(t, `level=warn message="disk: 90% full" caller=writer_test.go:\d+\n$`, buf.String())
+	buf.Reset()
+
+	// The date and time before the file:line are dropped.
+	std.SetFlags(log.LstdFlags | log.Lshortfile)
+	std.Print("hello")
+	require.Regexp(t, `level=warn message=hello caller=writer_test.go:\d+\n$`, buf.String())
+	buf.Reset()
+
+	// Lines without a file:line are logged as is.
+	std.SetFlags(0)
+	std.Print("at 10:30: done")
+	require.Contains(t, buf.String(), `level=warn message="at 10:30: done"`+"\n")
+	require.NotContains(t, buf.String(), "caller=")
+	buf.Reset()
+
+	// Without ParseCaller, the whole line is the message.
+	std = log.New(StdlibWriter(l, StdlibOpts{}), "", log.Lshortfile)
+	std.Print("hello")
+	require.Regexp(t, `level=info message="writer_test.go:\d+: hello"\n$`, buf.String())
+}